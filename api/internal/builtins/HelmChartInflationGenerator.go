@@ -4,19 +4,43 @@
 package builtins
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	goerrors "errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
 	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
+	"time"
 
+	"github.com/blang/semver/v4"
+	"sigs.k8s.io/kustomize/api/konfig"
 	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/api/resource"
 	"sigs.k8s.io/kustomize/api/types"
 	"sigs.k8s.io/kustomize/kyaml/errors"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
 	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+	"sigs.k8s.io/kustomize/kyaml/resid"
+	kyaml_utils "sigs.k8s.io/kustomize/kyaml/utils"
 	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
 	"sigs.k8s.io/kustomize/kyaml/yaml/merge2"
 	"sigs.k8s.io/yaml"
@@ -28,6 +52,112 @@ type HelmChartInflationGeneratorPlugin struct {
 	types.HelmGlobals
 	types.HelmChart
 	tmpDir string
+
+	// secretKeyPatterns are the compiled SecretKeyPatterns,
+	// if ForbidInlineSecrets.
+	secretKeyPatterns []*regexp.Regexp
+
+	// templateRetryPatterns are the compiled TemplateRetryPatterns,
+	// or their defaults.
+	templateRetryPatterns []*regexp.Regexp
+
+	// keyring is where the keyring downloaded from KeyringURL is kept.
+	keyring string
+
+	// username and password are decoded from CredentialsSecret,
+	// or from a basic Authorization header of Headers.
+	username string
+	password string
+
+	// registryToken is the token of a bearer Authorization header
+	// of Headers, and registryConfig the registry config file that
+	// hands it, or the username and password, to helm for an oci repo.
+	registryToken  string
+	registryConfig string
+
+	// repositoryConfig is the repository config file that hands
+	// the username and password to helm for any other repo.
+	repositoryConfig string
+
+	// preflightTimeout, if set, replaces defaultPreflightTimeout.
+	preflightTimeout time.Duration
+
+	// cacheLock is the lock file held on tmpDir when it's under CacheDir.
+	cacheLock string
+
+	// helmPlugins is the directory of helm's plugins, when
+	// it has to be passed to helm explicitly.
+	helmPlugins string
+
+	// workDir is the directory helm is run in, once the chart
+	// has been located, or empty to run it where kustomize runs.
+	workDir string
+
+	// helmMinorVersion is the minor version of helm V3
+	// found by checkHelmVersion.
+	helmMinorVersion int
+
+	// postRenderTransforms are applied in order to the rendered resources.
+	postRenderTransforms []PostRenderTransform
+
+	// deprecations are the deprecated values paths of the chart.
+	deprecations []string
+
+	// resolvedVersion is the version of the chart the last Generate
+	// rendered.
+	resolvedVersion string
+
+	// timings are the phase timings of the last Generate.
+	timings []types.HelmPhaseTiming
+
+	// keepTmpDir, if set, keeps cleanup from removing the tmp dir,
+	// for it to be reused by several renders.
+	keepTmpDir bool
+
+	// valueSources are the sources of the values
+	// of the last Generate, if ExplainValues.
+	valueSources []types.HelmValueSource
+
+	// kindCounts are the numbers of resources of each kind
+	// the last Generate produced, if ReportOutput.
+	kindCounts map[string]int
+
+	// manifestHash is a hash of the resources
+	// the last Generate produced, if ReportOutput.
+	manifestHash string
+
+	// outputFactory, if set, replaces the helpers' ResmapFactory
+	// for making ResMaps from helm's output.
+	outputFactory resMapFactory
+
+	// httpClient, if set, replaces the default client
+	// for downloading files given by URL.
+	httpClient *http.Client
+
+	// buildResources are the resources of the build so far,
+	// for ValuesFromConfigMaps.
+	buildResources resmap.ResMap
+
+	// configMapOverlays hold the values of ValuesFromConfigMaps,
+	// applied ahead of ValuesOverlays.
+	configMapOverlays []types.HelmValuesOverlay
+
+	// buildVars are the vars declared in the build, for VarReferences,
+	// and varOverlays hold their values, applied after ValuesOverlays.
+	buildVars   []types.Var
+	varOverlays []types.HelmValuesOverlay
+}
+
+// PostRenderTransform changes the resources rendered from a chart,
+// e.g. to relabel or filter them, before they're made into a ResMap.
+type PostRenderTransform = func([]*kyaml.RNode) ([]*kyaml.RNode, error)
+
+// resMapFactory is the part of *resmap.Factory used to parse
+// helm's output.  It's an alias so that callers of
+// SetResMapFactory can spell it out.
+type resMapFactory = interface {
+	NewResMapFromBytes(b []byte) (resmap.ResMap, error)
+	NewResMapFromRNodeSlice(s []*kyaml.RNode) (resmap.ResMap, error)
 }
 
 const (
@@ -36,12 +166,205 @@ const (
 	valuesMergeOptionReplace  = "replace"
 )
 
+const (
+	deprecationPolicyWarn  = "warn"
+	deprecationPolicyError = "error"
+)
+
+// deprecationsFile is the file of a chart that lists its deprecated
+// values paths, one per item of a YAML list.
+const deprecationsFile = "values.deprecations.yaml"
+
+// valuesFileName is the name, after the chart's, of the values file
+// helm is given, and baseValuesFileName that of the copy of ValuesFile
+// passed ahead of the inline values with InlineAlwaysWins or
+// MergeBaseFile.
+const (
+	valuesFileName     = "kustomize-values.yaml"
+	baseValuesFileName = "kustomize-base-values.yaml"
+)
+
+const (
+	onMissingValuesError  = "error"
+	onMissingValuesIgnore = "ignore"
+	onMissingValuesEmpty  = "empty"
+)
+
+const (
+	extraCollisionError     = "error"
+	extraCollisionExtraWins = "extra-wins"
+	extraCollisionChartWins = "chart-wins"
+	extraCollisionMerge     = "merge"
+)
+
+// the values of the helm.sh/hook-delete-policy annotation.
+const (
+	hookDeletePolicyBeforeCreation = "before-hook-creation"
+	hookDeletePolicySucceeded      = "hook-succeeded"
+	hookDeletePolicyFailed         = "hook-failed"
+)
+
+// configHashAnnotation holds, when AddConfigHashAnnotation is set,
+// a hash of the generator config that produced the resource.
+const configHashAnnotation = "kustomize.helm/config-hash"
+
+// chartAliasAnnotation holds, when ChartAlias is set,
+// the alias of the chart that produced the resource.
+const chartAliasAnnotation = "kustomize.helm/chart-alias"
+
+// warningsAnnotation holds, when RecordWarningsAnnotation is set,
+// the warnings helm printed while rendering the chart.
+const warningsAnnotation = "kustomize.helm/warnings"
+
+// warningLine matches the lines of helm's stderr that are warnings,
+// e.g. 'WARNING: This chart is deprecated' or
+// 'coalesce.go:286: warning: cannot overwrite table with non table'.
+var warningLine = regexp.MustCompile(`(?i)\bwarning\b`)
+
+// defaultGroup names the bucket GenerateByGroup uses for
+// resources whose kind isn't claimed by any group.
+const defaultGroup = "default"
+
+// defaultKindPriority is the priority of kinds missing from KindPriority.
+const defaultKindPriority = 50
+
+// containerFields are the fields holding lists of
+// containers in pod specs, and so container images.
+var containerFields = []string{"containers", "initContainers", "ephemeralContainers"}
+
+// repoSchemes are the URL schemes supported in Repo.
+var repoSchemes = []string{"http", "https", "oci", "s3", "gs"}
+
+// downloaderSchemes are the repo URL schemes helm only supports
+// by way of downloader plugins, such as helm-s3 and helm-gcs.
+var downloaderSchemes = []string{"s3", "gs"}
+
+// valuesPath matches a dotted path into a chart's values.
+var valuesPath = regexp.MustCompile(`^[^.]+(\.[^.]+)*$`)
+
+// setArgsKey matches the key of an assignment in SetArgs, a dotted
+// path whose segments may be indexed, and may have escaped dots,
+// e.g. 'a.b[0].c' or 'annotations.example\.com/key'.
+var setArgsKey = regexp.MustCompile(
+	`^(\\.|[^.\[\]=\\])+(\[\d+\])*(\.(\\.|[^.\[\]=\\])+(\[\d+\])*)*$`)
+
+// docSeparator matches a top level YAML document separator line,
+// allowing only whitespace or a comment after it, like kio does.
+var docSeparator = regexp.MustCompile(`(?m)^---[ \t]*(#.*)?$`)
+
+// defaultDownloadTimeout bounds the download of a file given by URL,
+// unless SetHTTPClient sets a client of its own.
+const defaultDownloadTimeout = time.Minute
+
+// defaultDecryptTimeout bounds DecryptCommand,
+// if DecryptTimeout isn't set.
+const defaultDecryptTimeout = time.Minute
+
+// defaultPreflightTimeout bounds the checks of Preflight that reach
+// the repo, unless SetPreflightTimeout sets a bound of its own.
+const defaultPreflightTimeout = 30 * time.Second
+
+// credentialsRepoName is the name the repo is given in the
+// repository config that hands helm its credentials.
+const credentialsRepoName = "kustomize-credentials"
+
+// explicitCRDsMinorVersion is the first minor version of helm V3
+// whose template takes both --include-crds and --skip-crds.
+const explicitCRDsMinorVersion = 1
+
+// cacheLockTimeout is how long to wait for another build
+// to release a directory under CacheDir.
+const cacheLockTimeout = 5 * time.Minute
+
+// cacheLockPollInterval is how often to check whether
+// a directory under CacheDir has been released.
+const cacheLockPollInterval = 100 * time.Millisecond
+
+// pullRetryDelay is how long to wait before retrying a failed
+// pull when the registry didn't say how long to wait.
+const pullRetryDelay = 2 * time.Second
+
+// templateRetryDelay is how long to wait before retrying
+// helm template after a transient failure.
+const templateRetryDelay = time.Second
+
+// rateLimited matches the ways helm reports that a registry
+// or repository refused a request with HTTP 429.
+var rateLimited = regexp.MustCompile(`(?i)\b429\b|toomanyrequests|too many requests`)
+
+// retryAfter extracts the number of seconds from a Retry-After hint.
+var retryAfter = regexp.MustCompile(`(?i)retry-after:?\s*(\d+)`)
+
+// unauthorized matches the ways helm reports that a registry
+// or repository refused a request with HTTP 401 or 403.
+var unauthorized = regexp.MustCompile(
+	`(?i)\b40[13]\b|unauthorized|forbidden|authentication required`)
+
+// chartNotFound matches the ways helm reports that a repository
+// or registry has no such chart, or no such version of it.
+var chartNotFound = regexp.MustCompile(
+	`(?i)chart "[^"]*"( version "[^"]*")? not found|no chart (name|version) found|` +
+		`\b404\b|: not found`)
+
+// helmFailures map what helm writes to stderr on the most common
+// failures to what to do about them, checked in order.
+var helmFailures = []struct {
+	stderr *regexp.Regexp
+	hint   string
+}{
+	{unauthorized, "authentication required: set credentialsSecret, or an Authorization header"},
+	{chartNotFound, "chart not found: check repo, name and version"},
+}
+
+// wrongMediaType matches the ways helm reports that an OCI artifact
+// doesn't have the media types of a helm chart.
+var wrongMediaType = regexp.MustCompile(
+	`(?i)unexpected media type|unsupported media type|` +
+		`unable to locate any layers of type|minimum number of descriptors`)
+
+// helmChartMediaTypes are the media types helm pulls OCI charts by,
+// with no flag to make it accept others.
+const helmChartMediaTypes = "config application/vnd.cncf.helm.config.v1+json, " +
+	"layer application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+
 var legalMergeOptions = []string{
 	valuesMergeOptionMerge,
 	valuesMergeOptionOverride,
 	valuesMergeOptionReplace,
 }
 
+// defaultSecretKeyPatterns are the SecretKeyPatterns used
+// if none are given.
+var defaultSecretKeyPatterns = []string{"password", "token", "apiKey"}
+
+// defaultTemplateRetryPatterns are the TemplateRetryPatterns used
+// if none are given: errors connecting to the API server.
+var defaultTemplateRetryPatterns = []string{
+	"connection refused",
+	"connection reset by peer",
+	"i/o timeout",
+	"TLS handshake timeout",
+}
+
+var legalOnMissingValues = []string{
+	onMissingValuesError,
+	onMissingValuesIgnore,
+	onMissingValuesEmpty,
+}
+
+var legalExtraCollisions = []string{
+	extraCollisionError,
+	extraCollisionExtraWins,
+	extraCollisionChartWins,
+	extraCollisionMerge,
+}
+
+var legalHookDeletePolicies = []string{
+	hookDeletePolicyBeforeCreation,
+	hookDeletePolicySucceeded,
+	hookDeletePolicyFailed,
+}
+
 // Config uses the input plugin configurations `config` to setup the generator
 // options
 func (p *HelmChartInflationGeneratorPlugin) Config(
@@ -52,9 +375,6 @@ func (p *HelmChartInflationGeneratorPlugin) Config(
 	if !h.GeneralConfig().HelmConfig.Enabled {
 		return fmt.Errorf("must specify --enable-helm")
 	}
-	if h.GeneralConfig().HelmConfig.Command == "" {
-		return fmt.Errorf("must specify --helm-command")
-	}
 
 	// CLI args takes precedence
 	if h.GeneralConfig().HelmConfig.KubeVersion != "" {
@@ -68,12 +388,75 @@ func (p *HelmChartInflationGeneratorPlugin) Config(
 	}
 
 	p.h = h
-	if err = yaml.Unmarshal(config, p); err != nil {
+	// Unmarshal into the embedded structs one by one; sigs.k8s.io/yaml
+	// doesn't see through embedding, and would otherwise mistake keys
+	// of maps such as kindPriority for fields, e.g. 'Namespace'.
+	if err = yaml.Unmarshal(config, &p.HelmGlobals); err != nil {
+		return
+	}
+	if err = yaml.Unmarshal(config, &p.HelmChart); err != nil {
 		return
 	}
+	if p.helmCommand() == "" {
+		return fmt.Errorf("must specify --helm-command or helmCommand")
+	}
 	return p.validateArgs()
 }
 
+// splitSetArgs splits a helm --set expression into its assignments,
+// at the commas that aren't escaped or in a {} list.
+func splitSetArgs(s string) []string {
+	var assignments []string
+	var depth, start int
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				assignments = append(assignments, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(assignments, s[start:])
+}
+
+// renderReleaseName renders ReleaseNameTemplate into ReleaseName.
+func (p *HelmChartInflationGeneratorPlugin) renderReleaseName() error {
+	if p.ReleaseName != "" {
+		return fmt.Errorf("releaseName and releaseNameTemplate cannot both be set")
+	}
+	tmpl, err := template.New("releaseName").
+		Option("missingkey=error").Parse(p.ReleaseNameTemplate)
+	if err != nil {
+		return errors.WrapPrefixf(err, "invalid releaseNameTemplate")
+	}
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+	var name strings.Builder
+	if err = tmpl.Execute(&name, map[string]map[string]string{
+		"Env":  env,
+		"Data": p.ReleaseNameData,
+	}); err != nil {
+		return errors.WrapPrefixf(err, "cannot render releaseNameTemplate")
+	}
+	if strings.TrimSpace(name.String()) == "" {
+		return fmt.Errorf("releaseNameTemplate '%s' renders an empty release name",
+			p.ReleaseNameTemplate)
+	}
+	p.ReleaseName = name.String()
+	return nil
+}
+
 // This uses the real file system since tmpDir may be used
 // by the helm subprocess.  Cannot use a chroot jail or fake
 // filesystem since we allow the user to use previously
@@ -81,17 +464,69 @@ func (p *HelmChartInflationGeneratorPlugin) Config(
 // owned by kustomize.
 func (p *HelmChartInflationGeneratorPlugin) establishTmpDir() (err error) {
 	if p.tmpDir != "" {
-		// already done.
-		return nil
+		// Already done, but a previous Generate may have cleaned it up.
+		return os.MkdirAll(p.tmpDir, 0700)
+	}
+	if p.CacheDir != "" {
+		return p.establishCacheDir()
 	}
 	p.tmpDir, err = os.MkdirTemp("", "kustomize-helm-")
 	return err
 }
 
+// establishCacheDir uses a directory under CacheDir, named
+// after a hash of the chart's config, as the tmp dir.
+func (p *HelmChartInflationGeneratorPlugin) establishCacheDir() error {
+	b, err := yaml.Marshal(p.HelmChart)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(append([]byte(p.ChartHome+"\n"), b...))
+	dir := filepath.Join(p.CacheDir, p.Name+"-"+hex.EncodeToString(sum[:8]))
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	p.tmpDir = dir
+	return nil
+}
+
+// lockCacheDir waits for, and takes, the lock on the tmp dir
+// if it's under CacheDir, since other builds may share it.
+func (p *HelmChartInflationGeneratorPlugin) lockCacheDir() error {
+	if p.CacheDir == "" {
+		return nil
+	}
+	if err := p.establishTmpDir(); err != nil {
+		return errors.WrapPrefixf(err, "unable to create cache dir")
+	}
+	lock := p.tmpDir + ".lock"
+	deadline := time.Now().Add(cacheLockTimeout)
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			p.cacheLock = lock
+			return f.Close()
+		}
+		if !os.IsExist(err) {
+			return errors.WrapPrefixf(err, "unable to lock cache dir")
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf(
+				"timed out waiting for '%s'; remove it if no other build is using the cache dir", lock)
+		}
+		time.Sleep(cacheLockPollInterval)
+	}
+}
+
 func (p *HelmChartInflationGeneratorPlugin) validateArgs() (err error) {
 	if p.Name == "" {
 		return fmt.Errorf("chart name cannot be empty")
 	}
+	if p.ReleaseNameTemplate != "" {
+		if err = p.renderReleaseName(); err != nil {
+			return err
+		}
+	}
 
 	// ChartHome might be consulted by the plugin (to read
 	// values files below it), so it must be located under
@@ -104,21 +539,263 @@ func (p *HelmChartInflationGeneratorPlugin) validateArgs() (err error) {
 	// The ValuesFile(s) may be consulted by the plugin, so it must
 	// be under the loader root (unless root restrictions are
 	// disabled).
-	if p.ValuesFile == "" {
-		p.ValuesFile = filepath.Join(p.absChartHome(), p.Name, "values.yaml")
+	// A chart taken from a resource or kept as a tarball isn't unpacked,
+	// so has no default values file to read; helm applies its defaults anyway.
+	if p.ValuesFile == "" && p.ChartFromResource == nil && !p.KeepTarball {
+		defaultValuesFile := "values.yaml"
+		if p.DefaultValuesFileName != "" {
+			defaultValuesFile = p.DefaultValuesFileName
+		}
+		p.ValuesFile = filepath.Join(p.absChartHome(), p.Name, defaultValuesFile)
+	}
+	if p.ChartFromResource != nil &&
+		(p.ChartFromResource.Path == "" || p.ChartFromResource.Key == "") {
+		return fmt.Errorf("chartFromResource requires both path and key")
 	}
 	for i, file := range p.AdditionalValuesFiles {
+		// the additional values filepaths must be relative to the kust
+		// root; resolve them first, so that the root restrictions are
+		// checked against the cleaned path helm is given, not just the
+		// path as written.
+		path := file
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(p.h.Loader().Root(), file)
+		}
+		// use Load() to enforce root restrictions
+		if _, err := p.h.Loader().Load(path); err != nil {
+			return errors.WrapPrefixf(err, "could not load additionalValuesFile '%s'", file)
+		}
+		p.AdditionalValuesFiles[i] = path
+	}
+
+	if p.ForceDependencyUpdate && !p.DependencyUpdate {
+		return fmt.Errorf("forceDependencyUpdate requires dependencyUpdate")
+	}
+
+	if p.WorkDir != "" {
+		if !filepath.IsAbs(p.WorkDir) {
+			p.WorkDir = filepath.Join(p.h.Loader().Root(), p.WorkDir)
+		}
+		if s, err := os.Stat(p.WorkDir); err != nil || !s.IsDir() {
+			return fmt.Errorf("workDir '%s' is not a directory", p.WorkDir)
+		}
+	}
+
+	if p.TLSCABundle != "" {
 		// use Load() to enforce root restrictions
-		if _, err := p.h.Loader().Load(file); err != nil {
-			return errors.WrapPrefixf(err, "could not load additionalValuesFile")
+		if _, err := p.h.Loader().Load(p.TLSCABundle); err != nil {
+			return errors.WrapPrefixf(err, "could not load tlsCABundle")
+		}
+		if !filepath.IsAbs(p.TLSCABundle) {
+			p.TLSCABundle = filepath.Join(p.h.Loader().Root(), p.TLSCABundle)
+		}
+	}
+
+	for _, overlay := range p.ValuesOverlays {
+		if !valuesPath.MatchString(overlay.Path) {
+			return fmt.Errorf("invalid valuesOverlays path '%s'", overlay.Path)
+		}
+	}
+	if p.ConditionsFile != "" {
+		if err = p.addConditions(); err != nil {
+			return err
+		}
+	}
+	if len(p.SubchartValuesFiles) > 0 {
+		if err = p.addSubchartValuesFiles(); err != nil {
+			return err
+		}
+	}
+
+	if p.CredentialsSecret != "" {
+		if err = p.loadCredentialsSecret(); err != nil {
+			return err
+		}
+	}
+	if len(p.Headers) > 0 {
+		if err = p.translateHeaders(); err != nil {
+			return err
+		}
+	}
+
+	if scheme, _, found := strings.Cut(p.Repo, "://"); found &&
+		!slices.Contains(repoSchemes, scheme) {
+		return fmt.Errorf("repo scheme '%s' is not one of %v", scheme, repoSchemes)
+	}
+
+	for path, value := range p.SetJSONValues {
+		if !json.Valid([]byte(value)) {
+			return fmt.Errorf("setJSONValues '%s' is not valid JSON: %s", path, value)
+		}
+	}
+
+	if p.SetArgs != "" {
+		for _, assignment := range splitSetArgs(p.SetArgs) {
+			if key, _, ok := strings.Cut(assignment, "="); !ok || !setArgsKey.MatchString(key) {
+				return fmt.Errorf("invalid setArgs assignment '%s'", assignment)
+			}
+		}
+	}
+
+	if len(p.CompareKubeVersions) > 0 &&
+		(len(p.CompareKubeVersions) != 2 || slices.Contains(p.CompareKubeVersions, "")) {
+		return fmt.Errorf("compareKubeVersions must list two versions")
+	}
+
+	if p.MaxErrorBytes < 0 {
+		return fmt.Errorf("maxErrorBytes cannot be negative")
+	}
+
+	if p.HelmOpTimeout != "" {
+		if _, err = time.ParseDuration(p.HelmOpTimeout); err != nil {
+			return errors.WrapPrefixf(err, "invalid helmOpTimeout")
+		}
+	}
+
+	if p.DecryptTimeout != "" {
+		if _, err = time.ParseDuration(p.DecryptTimeout); err != nil {
+			return errors.WrapPrefixf(err, "invalid decryptTimeout")
+		}
+	}
+
+	if p.PullTTL != "" {
+		if ttl, err := time.ParseDuration(p.PullTTL); err != nil {
+			return errors.WrapPrefixf(err, "invalid pullTTL")
+		} else if ttl <= 0 {
+			return fmt.Errorf("pullTTL must be positive")
+		}
+	}
+
+	if p.HelmVersionRegex != "" {
+		if _, err = regexp.Compile(p.HelmVersionRegex); err != nil {
+			return errors.WrapPrefixf(err, "invalid helmVersionRegex")
+		}
+	}
+
+	for _, field := range p.RemoveFields {
+		fieldPath := kyaml_utils.SmarterPathSplitter(field, ".")
+		if last := fieldPath[len(fieldPath)-1]; slices.Contains(fieldPath, "") ||
+			kyaml.IsListIndex(last) || kyaml.IsIdxNumber(last) {
+			return fmt.Errorf("invalid removeFields path '%s'", field)
+		}
+	}
+
+	for _, pattern := range p.ImageDenylist {
+		if _, err = path.Match(pattern, ""); err != nil {
+			return errors.WrapPrefixf(err, "invalid imageDenylist pattern '%s'", pattern)
+		}
+	}
+
+	if p.ForbidInlineSecrets {
+		patterns := p.SecretKeyPatterns
+		if len(patterns) == 0 {
+			patterns = defaultSecretKeyPatterns
+		}
+		p.secretKeyPatterns = nil
+		for _, pattern := range patterns {
+			r, err := regexp.Compile("(?i)" + pattern)
+			if err != nil {
+				return errors.WrapPrefixf(err, "invalid secretKeyPatterns pattern '%s'", pattern)
+			}
+			p.secretKeyPatterns = append(p.secretKeyPatterns, r)
+		}
+	}
+
+	if p.TemplateRetries < 0 {
+		return fmt.Errorf("templateRetries cannot be negative")
+	}
+	if p.TemplateRetries > 0 {
+		patterns := p.TemplateRetryPatterns
+		if len(patterns) == 0 {
+			patterns = defaultTemplateRetryPatterns
+		}
+		p.templateRetryPatterns = nil
+		for _, pattern := range patterns {
+			r, err := regexp.Compile(pattern)
+			if err != nil {
+				return errors.WrapPrefixf(err, "invalid templateRetryPatterns pattern '%s'", pattern)
+			}
+			p.templateRetryPatterns = append(p.templateRetryPatterns, r)
 		}
-		// the additional values filepaths must be relative to the kust root
-		p.AdditionalValuesFiles[i] = filepath.Join(p.h.Loader().Root(), file)
+	}
+
+	if p.CreateNamespace && p.outputNamespace() == "" {
+		return fmt.Errorf("createNamespace requires a namespace")
+	}
+
+	if p.SkipCRDs && p.IncludeCRDs {
+		return fmt.Errorf("skipCRDs and includeCRDs are mutually exclusive")
 	}
 
 	if err = p.errIfIllegalValuesMerge(); err != nil {
 		return err
 	}
+	if p.InlineAlwaysWins && p.ValuesMerge == valuesMergeOptionMerge {
+		return fmt.Errorf("inlineAlwaysWins can't be combined with valuesMerge '%s'",
+			valuesMergeOptionMerge)
+	}
+	if p.MergeBaseFile != "" {
+		if p.ValuesMerge == valuesMergeOptionReplace {
+			return fmt.Errorf("mergeBaseFile can't be combined with valuesMerge '%s'",
+				valuesMergeOptionReplace)
+		}
+		// use Load() to enforce root restrictions
+		if _, err = p.h.Loader().Load(p.MergeBaseFile); err != nil {
+			return errors.WrapPrefixf(err, "could not load mergeBaseFile")
+		}
+	}
+	for _, deprecated := range p.Deprecations {
+		if !valuesPath.MatchString(deprecated) {
+			return fmt.Errorf("invalid deprecations path '%s'", deprecated)
+		}
+	}
+	if p.DeprecationPolicy == "" {
+		p.DeprecationPolicy = deprecationPolicyWarn
+	} else if p.DeprecationPolicy != deprecationPolicyWarn &&
+		p.DeprecationPolicy != deprecationPolicyError {
+		return fmt.Errorf("deprecationPolicy must be one of [%s %s]",
+			deprecationPolicyWarn, deprecationPolicyError)
+	}
+
+	if p.OnMissingValues == "" {
+		p.OnMissingValues = onMissingValuesError
+	} else if !slices.Contains(legalOnMissingValues, p.OnMissingValues) {
+		return fmt.Errorf("onMissingValues must be one of %v", legalOnMissingValues)
+	}
+
+	if p.ExtraResourcesCollision == "" {
+		p.ExtraResourcesCollision = extraCollisionError
+	} else if !slices.Contains(legalExtraCollisions, p.ExtraResourcesCollision) {
+		return fmt.Errorf("extraResourcesCollision must be one of %v", legalExtraCollisions)
+	}
+
+	for _, ref := range p.ValuesFromConfigMaps {
+		if ref.Name == "" {
+			return fmt.Errorf("valuesFromConfigMaps entries require a name")
+		}
+	}
+
+	for path, name := range p.VarReferences {
+		if path == "" || name == "" {
+			return fmt.Errorf("varReferences entries require both a values path and a var name")
+		}
+	}
+
+	for _, ref := range p.ExcludeResources {
+		if ref.Kind == "" || ref.Name == "" {
+			return fmt.Errorf("excludeResources entries require both kind and name")
+		}
+	}
+
+	for _, policy := range p.DropHooksWithDeletePolicy {
+		if !slices.Contains(legalHookDeletePolicies, policy) {
+			return fmt.Errorf("dropHooksWithDeletePolicy must be one of %v", legalHookDeletePolicies)
+		}
+	}
+	if len(p.DropHooksWithDeletePolicy) > 0 && p.SkipHooks {
+		return fmt.Errorf("dropHooksWithDeletePolicy cannot be combined with skipHooks, " +
+			"which leaves out every hook")
+	}
 
 	// ConfigHome is not loaded by the plugin, and can be located anywhere.
 	if p.ConfigHome == "" {
@@ -159,161 +836,2644 @@ func (p *HelmChartInflationGeneratorPlugin) absChartHome() string {
 	return chartHome
 }
 
+// helmCommand returns the helm binary to run, preferring
+// the global one to the chart's own.
+func (p *HelmChartInflationGeneratorPlugin) helmCommand() string {
+	if p.h.GeneralConfig().HelmConfig.Command != "" {
+		return p.h.GeneralConfig().HelmConfig.Command
+	}
+	return p.HelmCommand
+}
+
 func (p *HelmChartInflationGeneratorPlugin) runHelmCommand(
 	args []string) ([]byte, error) {
+	stdout, _, err := p.runHelmCommandWithStderr(args)
+	return stdout, err
+}
+
+// runHelmCommandWithStderr is like runHelmCommand, but also
+// returns what helm wrote to stderr, even when it succeeded.
+func (p *HelmChartInflationGeneratorPlugin) runHelmCommandWithStderr(
+	args []string) ([]byte, []byte, error) {
+	return p.runHelmCommandContext(context.Background(), args)
+}
+
+// runHelmCommandContext is like runHelmCommandWithStderr,
+// but kills helm when ctx is done.
+func (p *HelmChartInflationGeneratorPlugin) runHelmCommandContext(
+	ctx context.Context, args []string) ([]byte, []byte, error) {
 	stdout := new(bytes.Buffer)
 	stderr := new(bytes.Buffer)
-	cmd := exec.Command(p.h.GeneralConfig().HelmConfig.Command, args...)
+	helm := p.helmCommand()
+	// A bare command name is looked for in PATH first,
+	// rather than failing obscurely.
+	if !strings.ContainsRune(helm, filepath.Separator) {
+		if _, err := exec.LookPath(helm); err != nil {
+			return nil, nil, fmt.Errorf("%s not found in PATH; install helm, "+
+				"or give the helm command as a path", helm)
+		}
+	}
+	if p.workDir != "" && !filepath.IsAbs(helm) && strings.ContainsRune(helm, filepath.Separator) {
+		// A relative path would be taken relative to the work dir.
+		if abs, err := filepath.Abs(helm); err == nil {
+			helm = abs
+		}
+	}
+	cmd := exec.CommandContext(ctx, helm, args...)
+	// Don't wait on children of a killed helm for its output.
+	cmd.WaitDelay = time.Second
+	cmd.Dir = p.workDir
 	cmd.Stdout = stdout
 	cmd.Stderr = stderr
 	env := []string{
 		fmt.Sprintf("HELM_CONFIG_HOME=%s", p.ConfigHome),
 		fmt.Sprintf("HELM_CACHE_HOME=%s/.cache", p.ConfigHome),
 		fmt.Sprintf("HELM_DATA_HOME=%s/.data", p.ConfigHome)}
+	if p.TLSCABundle != "" {
+		env = append(env, fmt.Sprintf("SSL_CERT_FILE=%s", p.TLSCABundle))
+	}
+	if p.helmPlugins != "" {
+		env = append(env, fmt.Sprintf("HELM_PLUGINS=%s", p.helmPlugins))
+	}
+	if p.registryConfig != "" {
+		env = append(env, fmt.Sprintf("HELM_REGISTRY_CONFIG=%s", p.registryConfig))
+	}
+	if p.repositoryConfig != "" {
+		env = append(env, fmt.Sprintf("HELM_REPOSITORY_CONFIG=%s", p.repositoryConfig))
+	}
 	cmd.Env = append(os.Environ(), env...)
 	err := cmd.Run()
 	errorOutput := stderr.String()
 	if slices.Contains(args, "--debug") {
 		errorOutput = " Helm stack trace:\n" + errorOutput + "\nHelm template:\n" + stdout.String() + "\n"
 	}
+	if p.MaxErrorBytes > 0 {
+		errorOutput = truncateMiddle(errorOutput, p.MaxErrorBytes)
+	}
 	if err != nil {
-		helm := p.h.GeneralConfig().HelmConfig.Command
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
 		err = errors.WrapPrefixf(
 			fmt.Errorf(
-				"unable to run: '%s %s' with env=%s (is '%s' installed?): %w",
-				helm, strings.Join(args, " "), env, helm, err),
+				"unable to run: '%s %s' with env=%s (%s): %w",
+				helm, strings.Join(args, " "), env, p.helmFailureHint(stderr.String()), err),
 			errorOutput,
 		)
 	}
-	return stdout.Bytes(), err
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+// updateDependencies fetches the dependencies of the chart at
+// chartPath into its charts directory, those pinned by its lock
+// file if it has one, unless ForceDependencyUpdate is set.
+func (p *HelmChartInflationGeneratorPlugin) updateDependencies(chartPath string) error {
+	if s, err := os.Stat(chartPath); err != nil || !s.IsDir() {
+		return fmt.Errorf(
+			"dependencyUpdate requires the chart '%s' to be a directory", chartPath)
+	}
+	command := "update"
+	if !p.ForceDependencyUpdate {
+		for _, lock := range []string{"Chart.lock", "requirements.lock"} {
+			if _, err := os.Stat(filepath.Join(chartPath, lock)); err == nil {
+				command = "build"
+				break
+			}
+		}
+	}
+	if _, err := p.runHelmCommand([]string{"dependency", command, chartPath}); err != nil {
+		return errors.WrapPrefixf(err, "could not %s the dependencies of helm chart '%s'",
+			command, p.Name)
+	}
+	return nil
+}
+
+// chartWorkDir returns the directory to run helm in for the chart
+// at chartPath: WorkDir, if set, or else the chart's directory or,
+// for a chart archive, the directory it's in.
+func (p *HelmChartInflationGeneratorPlugin) chartWorkDir(chartPath string) string {
+	if p.WorkDir != "" {
+		return p.WorkDir
+	}
+	if s, err := os.Stat(chartPath); err == nil && !s.IsDir() {
+		return filepath.Dir(chartPath)
+	}
+	return chartPath
+}
+
+// truncateMiddle cuts s down to its first and last max/2 bytes,
+// marking what was cut, if it's longer than max.
+func truncateMiddle(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	head, tail := max/2, max-max/2
+	return s[:head] + fmt.Sprintf("\n[truncated %d bytes]\n", len(s)-max) + s[len(s)-tail:]
+}
+
+// helmFailureHint tells what to do about a failure helm reported
+// on stderr, if it's a common one, and otherwise asks whether
+// helm is installed at all.
+func (p *HelmChartInflationGeneratorPlugin) helmFailureHint(stderr string) string {
+	for _, failure := range helmFailures {
+		if failure.stderr.MatchString(stderr) {
+			return failure.hint
+		}
+	}
+	return fmt.Sprintf("is '%s' installed?", p.helmCommand())
 }
 
 // createNewMergedValuesFile replaces/merges original values file with ValuesInline.
-func (p *HelmChartInflationGeneratorPlugin) createNewMergedValuesFile() (
+// The values are merged onto MergeBaseFile, if set, else onto valuesFile.
+func (p *HelmChartInflationGeneratorPlugin) createNewMergedValuesFile(valuesFile string) (
 	path string, err error) {
+	if err = p.spliceValuesOverlays(); err != nil {
+		return "", err
+	}
+	if err = p.checkDeprecations(); err != nil {
+		return "", err
+	}
+	if err = p.checkInlineSecrets(); err != nil {
+		return "", err
+	}
 	if p.ValuesMerge == valuesMergeOptionMerge ||
 		p.ValuesMerge == valuesMergeOptionOverride {
-		if err = p.replaceValuesInline(); err != nil {
+		if err = p.replaceValuesInline(valuesFile); err != nil {
 			return "", err
 		}
 	}
+	// Marshaling by way of JSON sorts the keys, so the file
+	// is the same from one run to the next.
 	var b []byte
 	b, err = yaml.Marshal(p.ValuesInline)
 	if err != nil {
 		return "", err
 	}
-	return p.writeValuesBytes(b)
+	return p.writeValuesBytes(valuesFileName, b)
 }
 
-func (p *HelmChartInflationGeneratorPlugin) replaceValuesInline() error {
-	pValues, err := p.h.Loader().Load(p.ValuesFile)
+func (p *HelmChartInflationGeneratorPlugin) replaceValuesInline(valuesFile string) error {
+	var pValues []byte
+	var err error
+	switch {
+	case p.MergeBaseFile != "":
+		// use Load() to enforce root restrictions
+		if pValues, err = p.h.Loader().Load(p.MergeBaseFile); err != nil {
+			return errors.WrapPrefixf(err, "could not load mergeBaseFile")
+		}
+	case valuesFile == "":
+		// Nothing to merge with.
+		return nil
+	default:
+		var missing bool
+		pValues, missing, err = p.loadValuesFile(valuesFile)
+		if err != nil || missing {
+			return err
+		}
+	}
+	chValues, err := kyaml.Parse(string(pValues))
+	if err != nil {
+		return errors.WrapPrefixf(err, "could not parse values file into rnode")
+	}
+	inlineValues, err := kyaml.FromMap(p.ValuesInline)
+	if err != nil {
+		return errors.WrapPrefixf(err, "could not parse values inline into rnode")
+	}
+	var outValues *kyaml.RNode
+	switch p.ValuesMerge {
+	// Function `merge2.Merge` overrides values in dest with values from src.
+	// To achieve override or merge behavior, we pass parameters in different order.
+	// Object passed as dest will be modified, so we copy it just in case someone
+	// decides to use it after this is called.
+	case valuesMergeOptionOverride:
+		outValues, err = merge2.Merge(inlineValues, chValues.Copy(), kyaml.MergeOptions{})
+	case valuesMergeOptionMerge:
+		outValues, err = merge2.Merge(chValues, inlineValues.Copy(), kyaml.MergeOptions{})
+	}
+	if err != nil {
+		return errors.WrapPrefixf(err, "could not merge values")
+	}
+	mapValues, err := outValues.Map()
+	if err != nil {
+		return errors.WrapPrefixf(err, "could not parse merged values into map")
+	}
+	p.ValuesInline = mapValues
+	return err
+}
+
+// addConditions loads the toggles in ConditionsFile, e.g.
+// 'subchartA.enabled: true', and turns each into a values
+// overlay applied ahead of those in ValuesOverlays.
+func (p *HelmChartInflationGeneratorPlugin) addConditions() error {
+	// use Load() to enforce root restrictions
+	b, err := p.h.Loader().Load(p.ConditionsFile)
+	if err != nil {
+		return errors.WrapPrefixf(err, "could not load conditionsFile")
+	}
+	var conditions map[string]bool
+	if err = yaml.Unmarshal(b, &conditions); err != nil {
+		return errors.WrapPrefixf(err, "conditionsFile must map values paths to booleans")
+	}
+	keys := make([]string, 0, len(conditions))
+	for k := range conditions {
+		if !valuesPath.MatchString(k) {
+			return fmt.Errorf("invalid conditionsFile path '%s'", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	overlays := make([]types.HelmValuesOverlay, 0, len(keys))
+	for _, k := range keys {
+		path, field := "", k
+		if i := strings.LastIndex(k, "."); i >= 0 {
+			path, field = k[:i], k[i+1:]
+		}
+		overlays = append(overlays, types.HelmValuesOverlay{
+			Path:   path,
+			Values: map[string]interface{}{field: conditions[k]},
+		})
+	}
+	p.ValuesOverlays = append(overlays, p.ValuesOverlays...)
+	return nil
+}
+
+// addSubchartValuesFiles loads the values files of SubchartValuesFiles
+// and turns each into a values overlay at its subchart's key, applied
+// ahead of the conditions and those in ValuesOverlays.
+func (p *HelmChartInflationGeneratorPlugin) addSubchartValuesFiles() error {
+	subcharts := make([]string, 0, len(p.SubchartValuesFiles))
+	for subchart := range p.SubchartValuesFiles {
+		if subchart == "" || strings.Contains(subchart, ".") {
+			return fmt.Errorf("invalid subchartValuesFiles subchart '%s'", subchart)
+		}
+		subcharts = append(subcharts, subchart)
+	}
+	sort.Strings(subcharts)
+	overlays := make([]types.HelmValuesOverlay, 0, len(subcharts))
+	for _, subchart := range subcharts {
+		file := p.SubchartValuesFiles[subchart]
+		// use Load() to enforce root restrictions
+		b, err := p.h.Loader().Load(file)
+		if err != nil {
+			return errors.WrapPrefixf(err, "could not load subchartValuesFiles file")
+		}
+		var values map[string]interface{}
+		if err = yaml.Unmarshal(b, &values); err != nil {
+			return errors.WrapPrefixf(err, "could not parse subchartValuesFiles file '%s'", file)
+		}
+		overlays = append(overlays, types.HelmValuesOverlay{Path: subchart, Values: values})
+	}
+	p.ValuesOverlays = append(overlays, p.ValuesOverlays...)
+	return nil
+}
+
+// loadDeprecations gathers the deprecated values paths listed by
+// Deprecations and by the chart's values.deprecations.yaml, if any.
+func (p *HelmChartInflationGeneratorPlugin) loadDeprecations(chartPath string) error {
+	p.deprecations = p.Deprecations
+	b, err := readChartFile(chartPath, deprecationsFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return errors.WrapPrefixf(err, "could not read %s", deprecationsFile)
+	}
+	var deprecations []string
+	if err = yaml.Unmarshal(b, &deprecations); err != nil {
+		return errors.WrapPrefixf(err, "%s must list values paths", deprecationsFile)
+	}
+	p.deprecations = append(slices.Clone(p.Deprecations), deprecations...)
+	return nil
+}
+
+// checkDeprecations warns about, or with DeprecationPolicy 'error'
+// fails on, ValuesInline setting any deprecated values path.
+func (p *HelmChartInflationGeneratorPlugin) checkDeprecations() error {
+	if len(p.deprecations) == 0 {
+		return nil
+	}
+	values, err := kyaml.FromMap(p.ValuesInline)
+	if err != nil {
+		return errors.WrapPrefixf(err, "could not parse values inline into rnode")
+	}
+	var used []string
+	for _, deprecated := range p.deprecations {
+		if field, err := values.Pipe(
+			kyaml.Lookup(strings.Split(deprecated, ".")...)); err == nil && field != nil {
+			used = append(used, deprecated)
+		}
+	}
+	if len(used) == 0 {
+		return nil
+	}
+	if p.DeprecationPolicy == deprecationPolicyError {
+		return fmt.Errorf("helm chart '%s' is given deprecated values: %s",
+			p.Name, strings.Join(used, ", "))
+	}
+	log.Printf("warning: helm chart '%s' is given deprecated values: %s",
+		p.Name, strings.Join(used, ", "))
+	return nil
+}
+
+// checkInlineSecrets returns an error listing the paths of the
+// inline values that look like secrets, if ForbidInlineSecrets.
+func (p *HelmChartInflationGeneratorPlugin) checkInlineSecrets() error {
+	if len(p.secretKeyPatterns) == 0 {
+		return nil
+	}
+	var found []string
+	var walk func(path string, value interface{})
+	walk = func(path string, value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for key, value := range v {
+				keyPath := key
+				if path != "" {
+					keyPath = path + "." + key
+				}
+				if s, ok := value.(string); ok && s != "" && p.isSecretKey(key) {
+					found = append(found, keyPath)
+				}
+				walk(keyPath, value)
+			}
+		case []interface{}:
+			for i, value := range v {
+				walk(fmt.Sprintf("%s[%d]", path, i), value)
+			}
+		}
+	}
+	walk("", p.ValuesInline)
+	if len(found) == 0 {
+		return nil
+	}
+	sort.Strings(found)
+	return fmt.Errorf(
+		"helm chart '%s' is given what look like secrets inline: %s; "+
+			"give them to the chart some other way",
+		p.Name, strings.Join(found, ", "))
+}
+
+func (p *HelmChartInflationGeneratorPlugin) isSecretKey(key string) bool {
+	for _, r := range p.secretKeyPatterns {
+		if r.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// spliceValuesOverlays merges each of ValuesOverlays
+// into ValuesInline at the overlay's path.
+func (p *HelmChartInflationGeneratorPlugin) spliceValuesOverlays() error {
+	for _, overlay := range p.valuesOverlays() {
+		// Nest the overlay's values under its path, so
+		// that merging them leaves everything else alone.
+		values := overlay.Values
+		if values == nil {
+			values = map[string]interface{}{}
+		}
+		if overlay.Path != "" {
+			keys := strings.Split(overlay.Path, ".")
+			for i := len(keys) - 1; i >= 0; i-- {
+				values = map[string]interface{}{keys[i]: values}
+			}
+		}
+		overlayValues, err := kyaml.FromMap(values)
+		if err != nil {
+			return errors.WrapPrefixf(err, "could not parse values overlay into rnode")
+		}
+		inlineValues, err := kyaml.FromMap(p.ValuesInline)
+		if err != nil {
+			return errors.WrapPrefixf(err, "could not parse values inline into rnode")
+		}
+		outValues, err := merge2.Merge(overlayValues, inlineValues, kyaml.MergeOptions{})
+		if err != nil {
+			return errors.WrapPrefixf(
+				err, "could not merge values overlay at '%s'", overlay.Path)
+		}
+		if p.ValuesInline, err = outValues.Map(); err != nil {
+			return errors.WrapPrefixf(err, "could not parse merged values into map")
+		}
+	}
+	return nil
+}
+
+// copyValuesFile to avoid branching.  TODO: get rid of this.
+func (p *HelmChartInflationGeneratorPlugin) copyValuesFile(name string) (string, error) {
+	b, missing, err := p.loadValuesFile(p.ValuesFile)
+	if err != nil {
+		return "", err
+	}
+	if missing && p.OnMissingValues == onMissingValuesIgnore {
+		return "", nil
+	}
+	return p.writeValuesBytes(name, b)
+}
+
+// loadValuesFile loads a values file, reporting it missing instead
+// of failing if it doesn't exist and OnMissingValues allows that.
+func (p *HelmChartInflationGeneratorPlugin) loadValuesFile(file string) (b []byte, missing bool, err error) {
+	b, err = p.load(file)
+	if err != nil && errors.Is(err, fs.ErrNotExist) &&
+		p.OnMissingValues != onMissingValuesError {
+		return nil, true, nil
+	}
+	if err != nil || p.DecryptCommand == "" {
+		return b, false, err
+	}
+	b, err = p.decryptValues(b)
+	return b, false, err
+}
+
+// decryptValues pipes encrypted values through DecryptCommand.
+func (p *HelmChartInflationGeneratorPlugin) decryptValues(b []byte) ([]byte, error) {
+	timeout := defaultDecryptTimeout
+	if p.DecryptTimeout != "" {
+		// Validated in config.
+		timeout, _ = time.ParseDuration(p.DecryptTimeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, p.DecryptCommand)
+	// Don't wait on children of a killed command for its output.
+	cmd.WaitDelay = time.Second
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, errors.WrapPrefixf(
+			fmt.Errorf("%w: %s", err, stderr.String()),
+			"unable to decrypt '%s' with '%s'", p.ValuesFile, p.DecryptCommand)
+	}
+	return stdout.Bytes(), nil
+}
+
+// Write a absolute path file in the tmp file system,
+// named after the chart and the given name.
+func (p *HelmChartInflationGeneratorPlugin) writeValuesBytes(
+	name string, b []byte) (string, error) {
+	if err := p.establishTmpDir(); err != nil {
+		return "", fmt.Errorf("cannot create tmp dir to write helm values")
+	}
+	path := filepath.Join(p.tmpDir, p.Name+"-"+name)
+	return path, errors.WrapPrefixf(os.WriteFile(path, b, 0644), "failed to write values file")
+}
+
+func (p *HelmChartInflationGeneratorPlugin) cleanup() {
+	if p.CacheDir != "" {
+		// Keep the dir for the next build, and let it in.
+		if p.cacheLock != "" {
+			os.Remove(p.cacheLock)
+			p.cacheLock = ""
+		}
+		return
+	}
+	if p.tmpDir != "" && !p.keepTmpDir {
+		os.RemoveAll(p.tmpDir)
+		// The keyring and plugin links were in there; redo them if needed.
+		p.keyring = ""
+		p.helmPlugins = ""
+	}
+}
+
+// Generate implements generator
+func (p *HelmChartInflationGeneratorPlugin) Generate() (rm resmap.ResMap, err error) {
+	defer func() {
+		if err != nil && p.KeepTmpOnError && p.CacheDir == "" && p.tmpDir != "" {
+			log.Printf("keeping tmp dir '%s' of helm chart '%s' for inspection",
+				p.tmpDir, p.Name)
+			return
+		}
+		p.cleanup()
+	}()
+	if err = p.lockCacheDir(); err != nil {
+		return nil, err
+	}
+	p.timings = nil
+	p.kindCounts = nil
+	p.manifestHash = ""
+	p.valueSources = nil
+	p.workDir = ""
+	start := time.Now()
+	// Leave the config as it was, for Generate to be run again.
+	defer func(chart types.HelmChart) {
+		p.HelmChart = chart
+	}(p.HelmChart)
+	if err = p.loadConfigMapValues(); err != nil {
+		return nil, err
+	}
+	if err = p.loadVarValues(); err != nil {
+		return nil, err
+	}
+	if err = p.checkHelmVersion(); err != nil {
+		return nil, err
+	}
+	if p.PluginsDir != "" {
+		// Templates may need them too, e.g. for subcharts
+		// from repos only a downloader plugin can reach.
+		if err = p.locateHelmPlugins(); err != nil {
+			return nil, err
+		}
+	}
+	start = p.recordTiming("version", start)
+	// Values that don't come from the chart are prepared while it's
+	// pulled.  An error pulling it is reported first, as it would be
+	// were they prepared afterwards.
+	var configHash, renderCache, valuesFile string
+	var additionalValuesFiles []string
+	var valuesErr error
+	var valuesDone chan struct{}
+	if p.needsPull() && !p.valuesNeedChart() {
+		if err = p.establishTmpDir(); err != nil {
+			return nil, err
+		}
+		valuesDone = make(chan struct{})
+		go func() {
+			defer close(valuesDone)
+			configHash, valuesFile, additionalValuesFiles, valuesErr = p.prepareValues()
+		}()
+		// Don't clean up the tmp dir from under it.
+		defer func() { <-valuesDone }()
+	}
+	chartPath, err := p.locateChart()
+	if err != nil {
+		if valuesDone != nil {
+			<-valuesDone
+			err = goerrors.Join(err, valuesErr)
+		}
+		return nil, err
+	}
+	p.workDir = p.chartWorkDir(chartPath)
+	p.resolvedVersion = p.Version
+	if p.RequireChartApiVersion != "" || p.RequireAppVersion != "" || p.hasFloatingVersion() {
+		if err = p.checkChartMetadata(chartPath); err != nil {
+			return nil, err
+		}
+	}
+	if p.DependencyUpdate {
+		if err = p.updateDependencies(chartPath); err != nil {
+			return nil, err
+		}
+	}
+	if p.WarnIfOutdated && p.Repo != "" && !p.hasFloatingVersion() {
+		p.warnIfOutdated()
+	}
+	if p.ChartNameOverride != "" || p.ReleaseService != "" {
+		if chartPath, err = p.overrideBuiltins(chartPath); err != nil {
+			return nil, err
+		}
+	}
+	start = p.recordTiming("pull", start)
+	if err = p.addEnvironmentValuesFile(); err != nil {
+		return nil, err
+	}
+	if err = p.loadDeprecations(chartPath); err != nil {
+		return nil, err
+	}
+	if p.ExplainValues {
+		if err = p.explainValues(chartPath); err != nil {
+			return nil, err
+		}
+	}
+	if valuesDone != nil {
+		<-valuesDone
+		err = valuesErr
+	} else {
+		configHash, valuesFile, additionalValuesFiles, err = p.prepareValues()
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.ValuesFile, p.AdditionalValuesFiles = valuesFile, additionalValuesFiles
+	if p.RenderCacheDir != "" {
+		if renderCache, err = p.renderCachePath(configHash, chartPath); err != nil {
+			return nil, err
+		}
+	}
+	start = p.recordTiming("values", start)
+	var stdout, stderr []byte
+	if renderCache != "" {
+		if stdout, err = readRenderCache(renderCache); err != nil {
+			return nil, err
+		}
+	}
+	if stdout == nil {
+		stdout, stderr, err = p.runTemplate(chartPath)
+		if err != nil {
+			return nil, err
+		}
+		if renderCache != "" {
+			if err = writeRenderCache(renderCache, stdout); err != nil {
+				return nil, err
+			}
+		}
+	}
+	start = p.recordTiming("template", start)
+	if rm, err = p.parseHelmOutput(stdout); err != nil {
+		return nil, err
+	}
+	if p.OverlayChart != "" {
+		if err = p.mergeOverlayChart(rm); err != nil {
+			return nil, err
+		}
+	}
+	if len(p.postRenderTransforms) > 0 {
+		if rm, err = p.applyPostRenderTransforms(rm); err != nil {
+			return nil, err
+		}
+	}
+	start = p.recordTiming("parse", start)
+	if p.SkipCRDs {
+		if err = removeCRDs(rm); err != nil {
+			return nil, err
+		}
+	}
+	if len(p.ExcludeByLabels) > 0 {
+		if err = p.removeByLabels(rm); err != nil {
+			return nil, err
+		}
+	}
+	if len(p.ExcludeResources) > 0 {
+		if err = p.removeExcludedResources(rm); err != nil {
+			return nil, err
+		}
+	}
+	if len(p.DropHooksWithDeletePolicy) > 0 {
+		if err = p.removeHooksByDeletePolicy(rm); err != nil {
+			return nil, err
+		}
+	}
+	if len(p.RemoveFields) > 0 {
+		if err = p.removeFields(rm); err != nil {
+			return nil, err
+		}
+	}
+	if err = p.addNamePrefixAndSuffix(rm); err != nil {
+		return nil, err
+	}
+	if err = p.addExtraResources(rm); err != nil {
+		return nil, err
+	}
+	if len(p.AllowedImageRegistries) > 0 {
+		if err = p.checkImageRegistries(rm); err != nil {
+			return nil, err
+		}
+	}
+	if len(p.ImageDenylist) > 0 {
+		if err = p.checkImageDenylist(rm); err != nil {
+			return nil, err
+		}
+	}
+	if p.RequireImageDigests {
+		if err = p.checkImageDigests(rm); err != nil {
+			return nil, err
+		}
+	}
+	if p.TargetNamespace != "" {
+		if err = p.setTargetNamespace(rm); err != nil {
+			return nil, err
+		}
+	}
+	if p.RequireNamespace && p.Namespace == "" {
+		if err = p.checkNamespaces(rm); err != nil {
+			return nil, err
+		}
+	}
+	if p.CreateNamespace {
+		if err = p.addNamespace(rm); err != nil {
+			return nil, err
+		}
+	}
+	if len(p.KindPriority) > 0 {
+		if err = p.sortByKindPriority(rm); err != nil {
+			return nil, err
+		}
+	}
+	if p.OrderHooksByWeight {
+		if err = orderHooksByWeight(rm); err != nil {
+			return nil, err
+		}
+	}
+	if p.AddConfigHashAnnotation {
+		if err = rm.AnnotateAll(configHashAnnotation, configHash); err != nil {
+			return nil, err
+		}
+	}
+	if p.ChartAlias != "" {
+		if err = rm.AnnotateAll(chartAliasAnnotation, p.ChartAlias); err != nil {
+			return nil, err
+		}
+	}
+	if p.RecordWarningsAnnotation {
+		if err = recordWarnings(rm, stderr); err != nil {
+			return nil, err
+		}
+	}
+	p.recordTiming("postprocess", start)
+	if p.ReportOutput {
+		p.kindCounts = make(map[string]int)
+		for _, r := range rm.Resources() {
+			p.kindCounts[r.GetKind()]++
+		}
+		if p.manifestHash, err = manifestHash(rm); err != nil {
+			return nil, err
+		}
+	}
+	return rm, nil
+}
+
+// manifestHash returns a hash of the resources in rm, as they'd be
+// written out, so without the annotations kustomize uses internally.
+func manifestHash(rm resmap.ResMap) (string, error) {
+	out := rm.DeepCopy()
+	out.RemoveBuildAnnotations()
+	b, err := out.AsYaml()
+	if err != nil {
+		return "", errors.WrapPrefixf(err, "could not hash generated resources")
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// runTemplate runs helm template on the chart at chartPath, retrying
+// up to TemplateRetries times if it fails in one of the transient
+// ways TemplateRetryPatterns match.
+func (p *HelmChartInflationGeneratorPlugin) runTemplate(chartPath string) (stdout, stderr []byte, err error) {
+	for attempt := 0; ; attempt++ {
+		stdout, stderr, err = p.runHelmCommandWithStderr(p.AsHelmArgsForChart(chartPath))
+		if err == nil || attempt >= p.TemplateRetries || !p.isTransient(stderr) {
+			return stdout, stderr, err
+		}
+		time.Sleep(templateRetryDelay)
+	}
+}
+
+// isTransient tells if helm's stderr matches one of
+// the templateRetryPatterns.
+func (p *HelmChartInflationGeneratorPlugin) isTransient(stderr []byte) bool {
+	for _, r := range p.templateRetryPatterns {
+		if r.Match(stderr) {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareValues computes the config hash, if it's needed, and
+// writes the values file helm is given into the tmp dir, returning
+// what ValuesFile and AdditionalValuesFiles should then be.  It
+// leaves them as they are, as it may run while the chart's pulled.
+func (p *HelmChartInflationGeneratorPlugin) prepareValues() (
+	configHash, valuesFile string, additional []string, err error) {
+	if p.AddConfigHashAnnotation || p.RenderCacheDir != "" {
+		if configHash, err = p.configHash(); err != nil {
+			return "", "", nil, err
+		}
+	}
+	valuesFile, additional = p.ValuesFile, p.AdditionalValuesFiles
+	inline := len(p.ValuesInline) > 0 || len(p.valuesOverlays()) > 0
+	if p.InlineAlwaysWins {
+		// AsHelmArgs passes ValuesFile last, so it's left to hold
+		// just the inline values, and what it held goes first.
+		if p.ValuesFile != "" && !(inline && p.ValuesMerge == valuesMergeOptionReplace) {
+			var path string
+			// Named apart, so the inline values don't overwrite it.
+			if path, err = p.copyValuesFile(baseValuesFileName); err != nil {
+				return "", "", nil, err
+			}
+			if path != "" {
+				additional = append([]string{path}, additional...)
+			}
+		}
+		valuesFile = ""
+		if inline {
+			valuesFile, err = p.createNewMergedValuesFile("")
+		}
+		return configHash, valuesFile, additional, err
+	}
+	if inline && p.MergeBaseFile != "" {
+		// ValuesFile goes to helm as is, ahead of the inline
+		// values merged onto MergeBaseFile.
+		if p.ValuesFile != "" {
+			if valuesFile, err = p.copyValuesFile(baseValuesFileName); err != nil {
+				return "", "", nil, err
+			}
+		}
+		var path string
+		if path, err = p.createNewMergedValuesFile(""); err != nil {
+			return "", "", nil, err
+		}
+		additional = append([]string{path}, additional...)
+	} else if inline {
+		valuesFile, err = p.createNewMergedValuesFile(p.ValuesFile)
+	} else if p.ValuesFile != "" {
+		valuesFile, err = p.copyValuesFile(valuesFileName)
+	}
+	return configHash, valuesFile, additional, err
+}
+
+// needsPull tells if locateChart is going to pull the chart.
+func (p *HelmChartInflationGeneratorPlugin) needsPull() bool {
+	if p.ChartFromResource != nil || p.Repo == "" {
+		return false
+	}
+	if p.KeepTarball {
+		_, exists := p.chartTarballExistsLocally()
+		return !exists
+	}
+	_, exists := p.chartExistsLocally()
+	return !exists
+}
+
+// valuesNeedChart tells if preparing the values reads anything
+// from the chart, so must wait for it to be pulled.  Inline values
+// are checked against the chart's deprecations, and an Environment
+// values file is in the chart.
+func (p *HelmChartInflationGeneratorPlugin) valuesNeedChart() bool {
+	if p.Environment != "" || p.ExplainValues ||
+		len(p.ValuesInline) > 0 || len(p.valuesOverlays()) > 0 {
+		return true
+	}
+	files := []string{p.ValuesFile}
+	if p.AddConfigHashAnnotation || p.RenderCacheDir != "" {
+		files = append(files, p.AdditionalValuesFiles...)
+	}
+	chartDir := filepath.Join(p.absChartHome(), p.Name)
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(p.h.Loader().Root(), file)
+		}
+		if rel, err := filepath.Rel(chartDir, file); err != nil ||
+			!strings.HasPrefix(rel, "..") {
+			return true
+		}
+	}
+	return false
+}
+
+// recordTiming notes how long the phase that began at start took,
+// if timings are being captured, and returns the current time as
+// the beginning of the next phase.
+func (p *HelmChartInflationGeneratorPlugin) recordTiming(phase string, start time.Time) time.Time {
+	now := time.Now()
+	if p.Debug && p.CaptureTiming {
+		p.timings = append(p.timings,
+			types.HelmPhaseTiming{Phase: phase, Duration: now.Sub(start)})
+	}
+	return now
+}
+
+// Timings returns how long each phase of the last Generate took,
+// if both Debug and CaptureTiming are set: checking the helm version,
+// pulling the chart, preparing values, running helm template, parsing
+// its output, and processing the resulting resources.
+func (p *HelmChartInflationGeneratorPlugin) Timings() []types.HelmPhaseTiming {
+	return p.timings
+}
+
+// recordWarnings annotates the first resource with the
+// warnings found in helm's stderr, if any.
+func recordWarnings(rm resmap.ResMap, stderr []byte) error {
+	var warnings []string
+	for _, line := range strings.Split(string(stderr), "\n") {
+		if warningLine.MatchString(line) {
+			warnings = append(warnings, strings.TrimSpace(line))
+		}
+	}
+	if len(warnings) == 0 || rm.Size() == 0 {
+		return nil
+	}
+	r := rm.Resources()[0]
+	annotations := r.GetAnnotations()
+	annotations[warningsAnnotation] = strings.Join(warnings, "\n")
+	return r.SetAnnotations(annotations)
+}
+
+// EnsurePulled pulls the chart, unless it's already in ChartHome,
+// and returns its local path, without rendering it.  It lets charts
+// be fetched ahead of, and in parallel with, their rendering.
+func (p *HelmChartInflationGeneratorPlugin) EnsurePulled() (string, error) {
+	defer p.cleanup()
+	if p.ChartFromResource != nil {
+		return "", fmt.Errorf(
+			"helm chart '%s' comes from a resource, so has nothing to pull", p.Name)
+	}
+	if err := p.lockCacheDir(); err != nil {
+		return "", err
+	}
+	if err := p.checkHelmVersion(); err != nil {
+		return "", err
+	}
+	return p.locateChart()
+}
+
+// locateChart returns the path of the chart to template, pulling
+// the chart or extracting it from a resource as needed.
+func (p *HelmChartInflationGeneratorPlugin) locateChart() (string, error) {
+	if p.ChartFromResource != nil {
+		return p.writeChartFromResource()
+	}
+	if p.KeepTarball {
+		return p.locateChartTarball()
+	}
+	path := filepath.Join(p.absChartHome(), p.Name)
+	if _, exists := p.chartExistsLocally(); !exists {
+		if p.Repo == "" {
+			return "", fmt.Errorf(
+				"no repo specified for pull, no chart found at '%s'", path)
+		}
+		if p.PullTTL != "" {
+			// helm won't untar over a stale chart.
+			if err := os.RemoveAll(path); err != nil {
+				return "", errors.WrapPrefixf(err, "unable to remove stale chart")
+			}
+		}
+		if err := p.pullChart(); err != nil {
+			return "", err
+		}
+		if p.PullTTL != "" {
+			// Start the TTL now, whatever times the archive gave the chart.
+			now := time.Now()
+			if err := os.Chtimes(path, now, now); err != nil {
+				return "", errors.WrapPrefixf(err, "unable to date pulled chart")
+			}
+		}
+	}
+	return path, nil
+}
+
+// locateChartTarball returns the path of the chart archive in
+// ChartHome, pulling it first if there's none.
+func (p *HelmChartInflationGeneratorPlugin) locateChartTarball() (string, error) {
+	if path, exists := p.chartTarballExistsLocally(); exists {
+		return path, nil
+	}
+	if p.Repo == "" {
+		return "", fmt.Errorf(
+			"no repo specified for pull, no chart archive found for '%s' in '%s'",
+			p.Name, p.absChartHome())
+	}
+	// unlike --untardir, helm doesn't create --destination
+	if err := os.MkdirAll(p.absChartHome(), 0755); err != nil {
+		return "", errors.WrapPrefixf(err, "unable to create chart home")
+	}
+	if err := p.pullChart(); err != nil {
+		return "", err
+	}
+	if path, exists := p.chartTarballExistsLocally(); exists {
+		return path, nil
+	}
+	return "", fmt.Errorf(
+		"pulled chart archive for '%s' not found in '%s'", p.Name, p.absChartHome())
+}
+
+// chartTarballExistsLocally returns the path of the archive of the
+// chart's Version that helm pull leaves in ChartHome or, if there's
+// no Version, of the latest such archive of any version.
+func (p *HelmChartInflationGeneratorPlugin) chartTarballExistsLocally() (string, bool) {
+	version := p.Version
+	if version == "" {
+		version = "*"
+	}
+	matches, err := filepath.Glob(
+		filepath.Join(p.absChartHome(), p.Name+"-"+version+".tgz"))
+	if err != nil || len(matches) == 0 {
+		return "", false
+	}
+	sort.Strings(matches)
+	return matches[len(matches)-1], true
+}
+
+// writeChartFromResource decodes the chart archive held by the
+// ConfigMap in ChartFromResource, and writes it to the tmp dir.
+func (p *HelmChartInflationGeneratorPlugin) writeChartFromResource() (string, error) {
+	src := p.ChartFromResource
+	b, err := p.h.Loader().Load(src.Path)
+	if err != nil {
+		return "", errors.WrapPrefixf(err, "could not load chartFromResource")
+	}
+	rm, err := p.h.ResmapFactory().NewResMapFromBytes(b)
+	if err != nil {
+		return "", errors.WrapPrefixf(err, "could not parse chartFromResource")
+	}
+	if len(rm.Resources()) != 1 {
+		return "", fmt.Errorf(
+			"chartFromResource '%s' must hold exactly one resource", src.Path)
+	}
+	r := rm.Resources()[0]
+	encoded, ok := r.GetBinaryDataMap()[src.Key]
+	if !ok {
+		if encoded, ok = r.GetDataMap()[src.Key]; !ok {
+			return "", fmt.Errorf(
+				"key '%s' not found in chartFromResource '%s'", src.Key, src.Path)
+		}
+	}
+	archive, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errors.WrapPrefixf(err, "could not decode chart archive")
+	}
+	if err = p.establishTmpDir(); err != nil {
+		return "", fmt.Errorf("cannot create tmp dir to write chart archive")
+	}
+	path := filepath.Join(p.tmpDir, p.Name+".tgz")
+	return path, errors.WrapPrefixf(os.WriteFile(path, archive, 0644), "failed to write chart archive")
+}
+
+// chartMetadata holds the fields of a chart's Chart.yaml
+// that the generator consults.
+type chartMetadata struct {
+	APIVersion string `json:"apiVersion"`
+	Version    string `json:"version"`
+	AppVersion string `json:"appVersion"`
+}
+
+// readChartMetadata reads the Chart.yaml of the chart at chartPath,
+// which may be a chart directory or a chart archive.
+func readChartMetadata(chartPath string) (*chartMetadata, error) {
+	b, err := readChartFile(chartPath, "Chart.yaml")
+	if err != nil {
+		return nil, errors.WrapPrefixf(err, "could not read Chart.yaml of '%s'", chartPath)
+	}
+	var meta chartMetadata
+	if err = yaml.Unmarshal(b, &meta); err != nil {
+		return nil, errors.WrapPrefixf(err, "could not parse Chart.yaml of '%s'", chartPath)
+	}
+	return &meta, nil
+}
+
+// readChartFile reads the file at the given path relative to the
+// chart at chartPath, which may be a chart directory or a chart
+// archive whose entries are all below the chart's directory.
+func readChartFile(chartPath, name string) ([]byte, error) {
+	info, err := os.Stat(chartPath)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return os.ReadFile(filepath.Join(chartPath, name))
+	}
+	f, err := os.Open(chartPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no %s in chart archive: %w", name, fs.ErrNotExist)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, rest, found := strings.Cut(header.Name, "/"); found && rest == name {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+// releaseService matches .Release.Service in a template,
+// but not e.g. .Release.ServiceAccount.
+var releaseService = regexp.MustCompile(`\$?\.Release\.Service\b`)
+
+// overrideBuiltins copies the chart at chartPath to the tmp dir, and
+// returns the path of the copy, whose Chart.yaml is renamed to
+// ChartNameOverride, and whose templates have .Release.Service replaced
+// by ReleaseService.  Helm has no flags to set these built-in objects.
+func (p *HelmChartInflationGeneratorPlugin) overrideBuiltins(chartPath string) (string, error) {
+	if err := p.establishTmpDir(); err != nil {
+		return "", err
+	}
+	dst := filepath.Join(p.tmpDir, "chart", p.Name)
+	// The tmp dir may be kept from an earlier render.
+	if err := os.RemoveAll(dst); err != nil {
+		return "", errors.WrapPrefixf(err, "unable to remove earlier chart copy")
+	}
+	if err := copyChart(chartPath, dst); err != nil {
+		return "", errors.WrapPrefixf(err, "could not copy chart '%s'", chartPath)
+	}
+	if p.ChartNameOverride != "" {
+		path := filepath.Join(dst, "Chart.yaml")
+		meta, err := kyaml.ReadFile(path)
+		if err != nil {
+			return "", errors.WrapPrefixf(err, "could not parse Chart.yaml of '%s'", chartPath)
+		}
+		if err = meta.PipeE(kyaml.SetField("name", kyaml.NewStringRNode(p.ChartNameOverride))); err != nil {
+			return "", errors.WrapPrefixf(err, "could not set chartNameOverride")
+		}
+		if err = kyaml.WriteFile(meta, path); err != nil {
+			return "", errors.WrapPrefixf(err, "could not write Chart.yaml")
+		}
+	}
+	if p.ReleaseService != "" {
+		service := []byte(strconv.Quote(p.ReleaseService))
+		err := filepath.WalkDir(dst, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(dst, path)
+			if err != nil {
+				return err
+			}
+			dirs := strings.Split(filepath.ToSlash(filepath.Dir(rel)), "/")
+			if !slices.Contains(dirs, "templates") {
+				return nil
+			}
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(path, releaseService.ReplaceAll(b, service), 0644)
+		})
+		if err != nil {
+			return "", errors.WrapPrefixf(err, "could not set releaseService")
+		}
+	}
+	return dst, nil
+}
+
+// copyChart copies the chart at chartPath, which may be a chart
+// directory or a chart archive, to the directory dst.
+func copyChart(chartPath, dst string) error {
+	info, err := os.Stat(chartPath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return filepath.WalkDir(chartPath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(chartPath, path)
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return os.MkdirAll(filepath.Join(dst, rel), 0755)
+			}
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(filepath.Join(dst, rel), b, 0644)
+		})
+	}
+	f, err := os.Open(chartPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// The entries are all below the chart's directory.
+		_, rest, found := strings.Cut(header.Name, "/")
+		if !found || header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if !filepath.IsLocal(rest) {
+			return fmt.Errorf("illegal path '%s' in chart archive", header.Name)
+		}
+		path := filepath.Join(dst, rest)
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if err = os.WriteFile(path, b, 0644); err != nil {
+			return err
+		}
+	}
+}
+
+// hasFloatingVersion reports whether Version leaves the version
+// of the chart to whatever the repo has at the time of the pull.
+func (p *HelmChartInflationGeneratorPlugin) hasFloatingVersion() bool {
+	return p.Version == "" || p.Version == "latest"
+}
+
+// warnIfOutdated logs a warning if Repo has a newer version
+// of the chart than Version.  Versions that aren't semantic
+// versions are only compared for equality.
+func (p *HelmChartInflationGeneratorPlugin) warnIfOutdated() {
+	if err := p.writeCredentials(context.Background()); err != nil {
+		log.Printf("warning: could not look up the latest version of helm chart '%s': %v",
+			p.Name, err)
+		return
+	}
+	// Without a version, helm shows the latest one.
+	ref := p.chartRefArgs()
+	if i := slices.Index(ref, "--version"); i >= 0 {
+		ref = slices.Delete(ref, i, i+2)
+	}
+	stdout, err := p.runHelmCommand(append([]string{"show", "chart"}, ref...))
+	if err != nil {
+		log.Printf("warning: could not look up the latest version of helm chart '%s': %v",
+			p.Name, err)
+		return
+	}
+	var meta chartMetadata
+	if err = yaml.Unmarshal(stdout, &meta); err != nil || meta.Version == "" {
+		log.Printf("warning: could not read the latest version of helm chart '%s'", p.Name)
+		return
+	}
+	newer := meta.Version != p.Version
+	latest, latestErr := semver.ParseTolerant(meta.Version)
+	pinned, pinnedErr := semver.ParseTolerant(p.Version)
+	if latestErr == nil && pinnedErr == nil {
+		newer = latest.GT(pinned)
+	}
+	if newer {
+		log.Printf("warning: helm chart '%s' is pinned to version %s, but %s is available in %s",
+			p.Name, p.Version, meta.Version, p.Repo)
+	}
+}
+
+// ResolvedVersion returns the version of the chart the last Generate
+// rendered, as recorded in its Chart.yaml if Version is floating,
+// so that builds using floating versions can be audited.
+func (p *HelmChartInflationGeneratorPlugin) ResolvedVersion() string {
+	return p.resolvedVersion
+}
+
+// explainValues works out which source each values path takes its
+// final value from.  It must run before the values files are
+// rewritten into the tmp dir.
+func (p *HelmChartInflationGeneratorPlugin) explainValues(chartPath string) error {
+	sources := make(map[string]string)
+	layer := func(source string, values map[string]interface{}) {
+		var walk func(prefix string, values map[string]interface{})
+		walk = func(prefix string, values map[string]interface{}) {
+			for key, value := range values {
+				path := key
+				if prefix != "" {
+					path = prefix + "." + key
+				}
+				// Helm merges maps, but anything else, including
+				// a list, replaces all that was at its path, and
+				// null removes it.
+				for other := range sources {
+					if other == path || strings.HasPrefix(other, path+".") {
+						if _, isMap := value.(map[string]interface{}); !isMap || other == path {
+							delete(sources, other)
+						}
+					}
+				}
+				switch v := value.(type) {
+				case map[string]interface{}:
+					walk(path, v)
+				case nil:
+				default:
+					sources[path] = source
+				}
+			}
+		}
+		walk("", values)
+	}
+	if err := p.layerValues(chartPath, layer); err != nil {
+		return err
+	}
+
+	p.valueSources = make([]types.HelmValueSource, 0, len(sources))
+	for path, source := range sources {
+		p.valueSources = append(p.valueSources,
+			types.HelmValueSource{Path: path, Source: source})
+	}
+	sort.Slice(p.valueSources, func(i, j int) bool {
+		return p.valueSources[i].Path < p.valueSources[j].Path
+	})
+	return nil
+}
+
+// layerValues passes the values of each source, named, to layer, in
+// the order helm layers them: the chart's defaults, then ValuesFile
+// and the inline values as merged per ValuesMerge, then
+// AdditionalValuesFiles and SetJSONValues.  With InlineAlwaysWins,
+// the inline values come after AdditionalValuesFiles instead.
+func (p *HelmChartInflationGeneratorPlugin) layerValues(
+	chartPath string, layer func(source string, values map[string]interface{})) error {
+	// Files are named as they would be in the kustomization.
+	rel := func(file string) string {
+		if r, err := filepath.Rel(p.h.Loader().Root(), file); err == nil &&
+			!strings.HasPrefix(r, "..") {
+			return r
+		}
+		return file
+	}
+	parse := func(source string, b []byte) (map[string]interface{}, error) {
+		var values map[string]interface{}
+		if err := yaml.Unmarshal(b, &values); err != nil {
+			return nil, errors.WrapPrefixf(err, "could not parse %s", source)
+		}
+		return values, nil
+	}
+
+	defaultValues := filepath.Join(chartPath, "values.yaml")
+	if b, err := readChartFile(chartPath, "values.yaml"); err == nil {
+		values, err := parse("chart defaults", b)
+		if err != nil {
+			return err
+		}
+		layer("chart defaults", values)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	var valuesFile map[string]interface{}
+	fileSource := "valuesFile " + rel(p.ValuesFile)
+	if p.ValuesFile == defaultValues {
+		fileSource = "chart defaults"
+	}
+	inline := len(p.ValuesInline) > 0 || len(p.valuesOverlays()) > 0
+	if p.ValuesFile != "" && !(inline && p.ValuesMerge == valuesMergeOptionReplace) {
+		b, _, err := p.loadValuesFile(p.ValuesFile)
+		if err != nil {
+			return err
+		}
+		if valuesFile, err = parse(fileSource, b); err != nil {
+			return err
+		}
+	}
+	layerInline := func() {
+		layer("valuesInline", p.ValuesInline)
+		for _, overlay := range p.valuesOverlays() {
+			values := overlay.Values
+			if overlay.Path != "" {
+				keys := strings.Split(overlay.Path, ".")
+				for i := len(keys) - 1; i >= 0; i-- {
+					values = map[string]interface{}{keys[i]: values}
+				}
+			}
+			layer("valuesOverlays "+overlay.Path, values)
+		}
+	}
+	// The inline values are merged onto MergeBaseFile, if any,
+	// rather than onto ValuesFile.
+	baseSource, baseValues := fileSource, valuesFile
+	if p.MergeBaseFile != "" && inline {
+		layer(fileSource, valuesFile)
+		b, err := p.h.Loader().Load(p.MergeBaseFile)
+		if err != nil {
+			return err
+		}
+		baseSource = "mergeBaseFile " + rel(p.MergeBaseFile)
+		if baseValues, err = parse(baseSource, b); err != nil {
+			return err
+		}
+	}
+	if p.ValuesMerge != valuesMergeOptionMerge {
+		layer(baseSource, baseValues)
+	}
+	if !p.InlineAlwaysWins {
+		layerInline()
+	}
+	if p.ValuesMerge == valuesMergeOptionMerge {
+		layer(baseSource, baseValues)
+	}
+
+	for _, file := range p.AdditionalValuesFiles {
+		b, err := p.h.Loader().Load(file)
+		if err != nil {
+			return err
+		}
+		values, err := parse("additionalValuesFiles "+rel(file), b)
+		if err != nil {
+			return err
+		}
+		layer("additionalValuesFiles "+rel(file), values)
+	}
+	if p.InlineAlwaysWins {
+		layerInline()
+	}
+	jsonPaths := make([]string, 0, len(p.SetJSONValues))
+	for path := range p.SetJSONValues {
+		jsonPaths = append(jsonPaths, path)
+	}
+	sort.Strings(jsonPaths)
+	for _, path := range jsonPaths {
+		var v interface{}
+		if err := json.Unmarshal([]byte(p.SetJSONValues[path]), &v); err != nil {
+			return err
+		}
+		keys := strings.Split(path, ".")
+		for i := len(keys) - 1; i >= 0; i-- {
+			v = map[string]interface{}{keys[i]: v}
+		}
+		layer("setJSONValues", v.(map[string]interface{}))
+	}
+	return nil
+}
+
+// ResolvedValues returns the values helm would render the chart with,
+// layering the chart's defaults, the values files and the inline values
+// the way Generate would have helm do, but without running helm
+// template, so that overrides can be checked cheaply.  The chart is
+// pulled if it isn't in ChartHome yet.
+func (p *HelmChartInflationGeneratorPlugin) ResolvedValues() (values map[string]interface{}, err error) {
+	defer p.cleanup()
+	if err = p.lockCacheDir(); err != nil {
+		return nil, err
+	}
+	if p.needsPull() {
+		if err = p.checkHelmVersion(); err != nil {
+			return nil, err
+		}
+	}
+	chartPath, err := p.locateChart()
+	if err != nil {
+		return nil, err
+	}
+	// Leave the files as they were for Generate.
+	defer func(files types.HelmValuesFiles) {
+		p.AdditionalValuesFiles = files
+	}(p.AdditionalValuesFiles)
+	if err = p.loadConfigMapValues(); err != nil {
+		return nil, err
+	}
+	if err = p.loadVarValues(); err != nil {
+		return nil, err
+	}
+	if err = p.addEnvironmentValuesFile(); err != nil {
+		return nil, err
+	}
+	values = make(map[string]interface{})
+	err = p.layerValues(chartPath, func(_ string, layer map[string]interface{}) {
+		mergeValues(values, layer)
+	})
+	return values, err
+}
+
+// mergeValues merges src into dst the way helm merges values:
+// maps are merged, null removes what was at its key, and anything
+// else, including a list, replaces it.  src is never modified.
+func mergeValues(dst, src map[string]interface{}) {
+	for key, value := range src {
+		switch v := value.(type) {
+		case nil:
+			delete(dst, key)
+		case map[string]interface{}:
+			d, isMap := dst[key].(map[string]interface{})
+			if !isMap {
+				d = make(map[string]interface{})
+				dst[key] = d
+			}
+			mergeValues(d, v)
+		default:
+			dst[key] = v
+		}
+	}
+}
+
+// ValueSources returns the source each values path of the last
+// Generate took its final value from, by path, if ExplainValues.
+func (p *HelmChartInflationGeneratorPlugin) ValueSources() []types.HelmValueSource {
+	return p.valueSources
+}
+
+// KindCounts returns how many resources of each kind the last
+// Generate produced, after all post-processing, if ReportOutput,
+// e.g. for dashboards showing what a chart deploys.
+func (p *HelmChartInflationGeneratorPlugin) KindCounts() map[string]int {
+	return p.kindCounts
+}
+
+// ManifestHash returns a sha256 hash of the resources the last
+// Generate produced, after all post-processing, if ReportOutput.
+// Unlike the config hash, it's of the output, not the input, so it
+// also changes when the chart itself does, letting reconcilers tell
+// whether there's anything new to apply without diffing.
+func (p *HelmChartInflationGeneratorPlugin) ManifestHash() string {
+	return p.manifestHash
+}
+
+// checkChartMetadata reads the chart's Chart.yaml to resolve a
+// floating Version, and returns an error if its apiVersion isn't
+// RequireChartApiVersion, or its appVersion isn't RequireAppVersion.
+func (p *HelmChartInflationGeneratorPlugin) checkChartMetadata(chartPath string) error {
+	meta, err := readChartMetadata(chartPath)
+	if err != nil {
+		return err
+	}
+	if p.hasFloatingVersion() {
+		p.resolvedVersion = meta.Version
+	}
+	if p.RequireChartApiVersion != "" && meta.APIVersion != p.RequireChartApiVersion {
+		return fmt.Errorf(
+			"helm chart '%s' has apiVersion '%s' but requireChartApiVersion is '%s'",
+			p.Name, meta.APIVersion, p.RequireChartApiVersion)
+	}
+	if p.RequireAppVersion != "" && meta.AppVersion != p.RequireAppVersion {
+		return fmt.Errorf(
+			"helm chart '%s' has appVersion '%s' but requireAppVersion is '%s'",
+			p.Name, meta.AppVersion, p.RequireAppVersion)
+	}
+	return nil
+}
+
+// SetResMapFactory makes the generator parse helm's output with
+// the given factory, e.g. one that records the output in tests,
+// instead of the plugin helpers' ResmapFactory.
+func (p *HelmChartInflationGeneratorPlugin) SetResMapFactory(f resMapFactory) {
+	p.outputFactory = f
+}
+
+// SetPreflightTimeout bounds the checks of Preflight that reach
+// the repo by d, rather than defaultPreflightTimeout.
+func (p *HelmChartInflationGeneratorPlugin) SetPreflightTimeout(d time.Duration) {
+	p.preflightTimeout = d
+}
+
+// SetHTTPClient makes the generator download the files given by URL,
+// i.e. a remote ValuesFile and the keyring at KeyringURL, with the
+// given client, so embedders can set timeouts, proxies and TLS in one
+// place, and tests can stub the network.
+func (p *HelmChartInflationGeneratorPlugin) SetHTTPClient(client *http.Client) {
+	p.httpClient = client
+}
+
+// load reads the file at path, downloading it if it's a URL.
+// Other paths are loaded with Load() to enforce the loader's
+// restrictions.
+func (p *HelmChartInflationGeneratorPlugin) load(path string) ([]byte, error) {
+	if !strings.HasPrefix(path, "https://") && !strings.HasPrefix(path, "http://") {
+		return p.h.Loader().Load(path)
+	}
+	client := p.httpClient
+	if client == nil {
+		client = &http.Client{Timeout: defaultDownloadTimeout}
+	}
+	resp, err := client.Get(path)
+	if err != nil {
+		return nil, errors.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("could not download '%s': %s", path, resp.Status)
+	}
+	b, err := io.ReadAll(resp.Body)
+	return b, errors.Wrap(err)
+}
+
+// SetBuildResources gives the generator the resources of the build
+// so far, for it to find the ConfigMaps of ValuesFromConfigMaps in.
+// Kustomize calls it before Generate; the generator doesn't change them.
+func (p *HelmChartInflationGeneratorPlugin) SetBuildResources(rm resmap.ResMap) {
+	p.buildResources = rm
+}
+
+// loadConfigMapValues reads the values of ValuesFromConfigMaps from
+// the build resources into configMapOverlays, afresh on every run.
+func (p *HelmChartInflationGeneratorPlugin) loadConfigMapValues() error {
+	p.configMapOverlays = nil
+	for _, ref := range p.ValuesFromConfigMaps {
+		values, err := p.configMapValues(ref)
+		if err != nil {
+			return err
+		}
+		p.configMapOverlays = append(p.configMapOverlays,
+			types.HelmValuesOverlay{Values: values})
+	}
+	return nil
+}
+
+// valuesOverlays returns the overlays to apply to ValuesInline: those
+// of ValuesFromConfigMaps, then ValuesOverlays, then those of VarReferences.
+func (p *HelmChartInflationGeneratorPlugin) valuesOverlays() []types.HelmValuesOverlay {
+	if len(p.configMapOverlays) == 0 && len(p.varOverlays) == 0 {
+		return p.ValuesOverlays
+	}
+	overlays := slices.Clone(p.configMapOverlays)
+	overlays = append(overlays, p.ValuesOverlays...)
+	return append(overlays, p.varOverlays...)
+}
+
+// SetBuildVars gives the generator the vars declared in the build,
+// for VarReferences.  Kustomize calls it before Generate.
+func (p *HelmChartInflationGeneratorPlugin) SetBuildVars(vars []types.Var) {
+	p.buildVars = vars
+}
+
+// loadVarValues resolves the vars of VarReferences against the
+// build resources into varOverlays, afresh on every run.
+func (p *HelmChartInflationGeneratorPlugin) loadVarValues() error {
+	p.varOverlays = nil
+	paths := make([]string, 0, len(p.VarReferences))
+	for path := range p.VarReferences {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		value, err := p.varValue(p.VarReferences[path])
+		if err != nil {
+			return errors.WrapPrefixf(err, "varReferences '%s'", path)
+		}
+		// Set the value at the last key of the path.
+		var overlay types.HelmValuesOverlay
+		key := path
+		if i := strings.LastIndex(path, "."); i >= 0 {
+			overlay.Path, key = path[:i], path[i+1:]
+		}
+		overlay.Values = map[string]interface{}{key: value}
+		p.varOverlays = append(p.varOverlays, overlay)
+	}
+	return nil
+}
+
+// varValue returns the value of the var of the build named name,
+// taken from the build resource it refers to.
+func (p *HelmChartInflationGeneratorPlugin) varValue(name string) (interface{}, error) {
+	i := slices.IndexFunc(p.buildVars, func(v types.Var) bool { return v.Name == name })
+	if i < 0 {
+		return nil, fmt.Errorf("var '%s' is not declared in the build", name)
+	}
+	v := p.buildVars[i]
+	v.Defaulting()
+	id := resid.NewResIdWithNamespace(v.ObjRef.GVK(), v.ObjRef.Name, v.ObjRef.Namespace)
+	matches := id.GvknEquals
+	if id.Namespace != "" || id.IsClusterScoped() {
+		// As for vars resolved by kustomize, an empty
+		// namespace matches any.
+		matches = id.Equals
+	}
+	var found []*resource.Resource
+	if p.buildResources != nil {
+		found = p.buildResources.GetMatchingResourcesByAnyId(matches)
+	}
+	if len(found) != 1 {
+		return nil, fmt.Errorf(
+			"var '%s' refers to %d resources of the build, not one", name, len(found))
+	}
+	value, err := found[0].GetFieldValue(v.FieldRef.FieldPath)
+	if err != nil {
+		return nil, errors.WrapPrefixf(err,
+			"field '%s' of var '%s' not found", v.FieldRef.FieldPath, name)
+	}
+	return value, nil
+}
+
+// configMapValues returns the values in the ConfigMap of the build
+// that ref names.
+func (p *HelmChartInflationGeneratorPlugin) configMapValues(ref types.HelmConfigMapValues) (map[string]interface{}, error) {
+	var data map[string]string
+	found := false
+	if p.buildResources != nil {
+		for _, r := range p.buildResources.Resources() {
+			if r.GetKind() == "ConfigMap" && r.OrgId().Name == ref.Name {
+				data, found = r.GetDataMap(), true
+				break
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf(
+			"valuesFromConfigMaps ConfigMap '%s' is not in the build", ref.Name)
+	}
+	values := make(map[string]interface{})
+	if ref.Key == "" {
+		for k, v := range data {
+			values[k] = v
+		}
+		return values, nil
+	}
+	doc, ok := data[ref.Key]
+	if !ok {
+		return nil, fmt.Errorf(
+			"key '%s' not found in valuesFromConfigMaps ConfigMap '%s'", ref.Key, ref.Name)
+	}
+	if err := yaml.Unmarshal([]byte(doc), &values); err != nil {
+		return nil, errors.WrapPrefixf(err,
+			"could not parse key '%s' of valuesFromConfigMaps ConfigMap '%s'", ref.Key, ref.Name)
+	}
+	return values, nil
+}
+
+// SetPostRenderTransforms makes the generator apply the given
+// transforms in order to the resources rendered from the chart,
+// so embedders can change them without forking the generator.
+func (p *HelmChartInflationGeneratorPlugin) SetPostRenderTransforms(transforms ...PostRenderTransform) {
+	p.postRenderTransforms = transforms
+}
+
+// applyPostRenderTransforms runs the resources through postRenderTransforms.
+func (p *HelmChartInflationGeneratorPlugin) applyPostRenderTransforms(rm resmap.ResMap) (resmap.ResMap, error) {
+	nodes := rm.ToRNodeSlice()
+	for i, transform := range p.postRenderTransforms {
+		var err error
+		if nodes, err = transform(nodes); err != nil {
+			return nil, errors.WrapPrefixf(err, "post-render transform %d", i)
+		}
+	}
+	return p.resMapFactory().NewResMapFromRNodeSlice(nodes)
+}
+
+// resMapFactory returns the factory that makes ResMaps of helm's output.
+func (p *HelmChartInflationGeneratorPlugin) resMapFactory() resMapFactory {
+	if p.outputFactory != nil {
+		return p.outputFactory
+	}
+	return p.h.ResmapFactory()
+}
+
+// parseHelmOutput converts the output of 'helm template' to a ResMap.
+func (p *HelmChartInflationGeneratorPlugin) parseHelmOutput(stdout []byte) (resmap.ResMap, error) {
+	factory := p.resMapFactory()
+	rm, resMapErr := factory.NewResMapFromBytes(stdout)
+	if resMapErr == nil || p.StrictParse {
+		return rm, resMapErr
+	}
+	// try to remove the contents before first "---" because
+	// helm may produce messages to stdout before it
+	r := &kio.ByteReader{Reader: bytes.NewBuffer(stripPreamble(stdout)), OmitReaderAnnotations: true}
+	nodes, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading helm output: %w", err)
+	}
+
+	if len(nodes) != 0 {
+		rm, err = factory.NewResMapFromRNodeSlice(nodes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse rnode slice into resource map: %w", err)
+		}
+		return rm, nil
+	}
+	return nil, fmt.Errorf("could not parse bytes into resource map: %w", resMapErr)
+}
+
+// mergeOverlayChart renders OverlayChart with the release and values
+// of the main chart, and merges each resource it produces into the
+// resource with the same id, or adds it if there's no such resource.
+func (p *HelmChartInflationGeneratorPlugin) mergeOverlayChart(rm resmap.ResMap) error {
+	stdout, err := p.runHelmCommand(p.AsHelmArgsForChart(
+		filepath.Join(p.absChartHome(), p.OverlayChart)))
+	if err != nil {
+		return errors.WrapPrefixf(err, "could not render overlayChart")
+	}
+	overlay, err := p.parseHelmOutput(stdout)
+	if err != nil {
+		return errors.WrapPrefixf(err, "could not parse overlayChart")
+	}
+	for _, o := range overlay.Resources() {
+		matches := rm.GetMatchingResourcesByCurrentId(o.CurId().Equals)
+		if len(matches) == 0 {
+			if err = rm.Append(o); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err = merge2.Merge(
+			&o.RNode, &matches[0].RNode, kyaml.MergeOptions{}); err != nil {
+			return errors.WrapPrefixf(err, "could not merge overlayChart %s", o.CurId())
+		}
+	}
+	return nil
+}
+
+// removeCRDs removes all CustomResourceDefinitions, whether
+// they came from the chart's crds directory or its templates.
+func removeCRDs(rm resmap.ResMap) error {
+	for _, r := range rm.Resources() {
+		if r.GetKind() != "CustomResourceDefinition" {
+			continue
+		}
+		if err := rm.Remove(r.CurId()); err != nil {
+			return errors.WrapPrefixf(err, "could not remove %s", r.CurId())
+		}
+	}
+	return nil
+}
+
+// removeByLabels removes the resources having
+// all the labels in ExcludeByLabels.
+func (p *HelmChartInflationGeneratorPlugin) removeByLabels(rm resmap.ResMap) error {
+	for _, r := range rm.Resources() {
+		labels := r.GetLabels()
+		matches := true
+		for k, v := range p.ExcludeByLabels {
+			if value, ok := labels[k]; !ok || value != v {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+		if err := rm.Remove(r.CurId()); err != nil {
+			return errors.WrapPrefixf(err, "could not remove %s", r.CurId())
+		}
+	}
+	return nil
+}
+
+// removeExcludedResources removes the resources named by
+// ExcludeResources, warning of those that match none if
+// WarnOnUnmatchedExcludes.
+func (p *HelmChartInflationGeneratorPlugin) removeExcludedResources(rm resmap.ResMap) error {
+	for _, ref := range p.ExcludeResources {
+		matched := false
+		for _, r := range rm.Resources() {
+			if r.GetKind() != ref.Kind || r.GetName() != ref.Name ||
+				(ref.Namespace != "" && r.GetNamespace() != ref.Namespace) {
+				continue
+			}
+			matched = true
+			if err := rm.Remove(r.CurId()); err != nil {
+				return errors.WrapPrefixf(err, "could not remove %s", r.CurId())
+			}
+		}
+		if !matched && p.WarnOnUnmatchedExcludes {
+			log.Printf("warning: helm chart '%s' has no %s '%s' to exclude",
+				p.Name, ref.Kind, ref.Name)
+		}
+	}
+	return nil
+}
+
+// removeHooksByDeletePolicy removes the helm hooks whose
+// helm.sh/hook-delete-policy has any of DropHooksWithDeletePolicy.
+func (p *HelmChartInflationGeneratorPlugin) removeHooksByDeletePolicy(rm resmap.ResMap) error {
+	for _, r := range rm.Resources() {
+		annotations := r.GetAnnotations()
+		if _, isHook := annotations["helm.sh/hook"]; !isHook {
+			continue
+		}
+		policies := strings.Split(annotations["helm.sh/hook-delete-policy"], ",")
+		if !slices.ContainsFunc(policies, func(policy string) bool {
+			return slices.Contains(p.DropHooksWithDeletePolicy, strings.TrimSpace(policy))
+		}) {
+			continue
+		}
+		if err := rm.Remove(r.CurId()); err != nil {
+			return errors.WrapPrefixf(err, "could not remove %s", r.CurId())
+		}
+	}
+	return nil
+}
+
+// removeFields deletes the fields at the paths of RemoveFields
+// from every resource that has them.
+func (p *HelmChartInflationGeneratorPlugin) removeFields(rm resmap.ResMap) error {
+	for _, r := range rm.Resources() {
+		for _, field := range p.RemoveFields {
+			fieldPath := kyaml_utils.SmarterPathSplitter(field, ".")
+			parent, err := r.Pipe(kyaml.Lookup(fieldPath[:len(fieldPath)-1]...))
+			if err != nil {
+				return errors.WrapPrefixf(err,
+					"could not look up removeFields path '%s' in %s", field, r.CurId())
+			}
+			if parent == nil {
+				continue
+			}
+			if err = parent.PipeE(kyaml.Clear(fieldPath[len(fieldPath)-1])); err != nil {
+				return errors.WrapPrefixf(err,
+					"could not remove field '%s' from %s", field, r.CurId())
+			}
+		}
+	}
+	return nil
+}
+
+// addNamePrefixAndSuffix applies NamePrefix and NameSuffix to the
+// metadata.name of every resource.  Unlike the prefix and suffix
+// transformers, it doesn't update references to the renamed resources.
+func (p *HelmChartInflationGeneratorPlugin) addNamePrefixAndSuffix(rm resmap.ResMap) error {
+	if p.NamePrefix == "" && p.NameSuffix == "" {
+		return nil
+	}
+	for _, r := range rm.Resources() {
+		if err := r.SetName(p.NamePrefix + r.GetName() + p.NameSuffix); err != nil {
+			return errors.WrapPrefixf(err, "could not rename %s", r.CurId())
+		}
+	}
+	return nil
+}
+
+// addExtraResources appends ExtraResources to the resources
+// generated from the chart.
+func (p *HelmChartInflationGeneratorPlugin) addExtraResources(rm resmap.ResMap) error {
+	for _, extra := range p.ExtraResources {
+		b := []byte(extra)
+		if !strings.Contains(extra, "\n") {
+			var err error
+			// use Load() to enforce root restrictions
+			if b, err = p.h.Loader().Load(extra); err != nil {
+				return errors.WrapPrefixf(err, "could not load extraResources file")
+			}
+		}
+		extraRm, err := p.h.ResmapFactory().NewResMapFromBytes(b)
+		if err != nil {
+			return errors.WrapPrefixf(err, "could not parse extraResources")
+		}
+		for _, r := range extraRm.Resources() {
+			if err = p.addExtraResource(rm, r); err != nil {
+				return errors.WrapPrefixf(err, "could not add extraResources")
+			}
+		}
+	}
+	return nil
+}
+
+// addExtraResource adds an extra resource to those of the chart,
+// resolving a collision with one of them per ExtraResourcesCollision.
+func (p *HelmChartInflationGeneratorPlugin) addExtraResource(rm resmap.ResMap, r *resource.Resource) error {
+	matches := rm.GetMatchingResourcesByCurrentId(r.CurId().Equals)
+	if len(matches) == 0 || p.ExtraResourcesCollision == extraCollisionError {
+		return rm.Append(r)
+	}
+	switch p.ExtraResourcesCollision {
+	case extraCollisionExtraWins:
+		_, err := rm.Replace(r)
+		return err
+	case extraCollisionMerge:
+		return matches[0].ApplySmPatch(r)
+	}
+	return nil
+}
+
+// checkImageRegistries returns an error listing every container
+// image that doesn't come from one of AllowedImageRegistries.
+func (p *HelmChartInflationGeneratorPlugin) checkImageRegistries(rm resmap.ResMap) error {
+	allowed := make(map[string]bool, len(p.AllowedImageRegistries))
+	for _, registry := range p.AllowedImageRegistries {
+		allowed[normalizeRegistry(registry)] = true
+	}
+	var violations []string
+	for _, r := range rm.Resources() {
+		if r.GetKind() == "CustomResourceDefinition" {
+			continue
+		}
+		for _, image := range containerImages(r.YNode(), nil) {
+			if registry := imageRegistry(image); !allowed[registry] {
+				violations = append(violations, fmt.Sprintf(
+					"%s: image '%s' is from registry '%s'", r.CurId(), image, registry))
+			}
+		}
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf(
+			"helm chart '%s' uses images from registries not in allowedImageRegistries:\n- %s",
+			p.Name, strings.Join(violations, "\n- "))
+	}
+	return nil
+}
+
+// checkImageDenylist returns an error listing every container
+// image that matches one of the patterns of ImageDenylist.
+func (p *HelmChartInflationGeneratorPlugin) checkImageDenylist(rm resmap.ResMap) error {
+	var violations []string
+	for _, r := range rm.Resources() {
+		if r.GetKind() == "CustomResourceDefinition" {
+			continue
+		}
+		for _, image := range containerImages(r.YNode(), nil) {
+			for _, pattern := range p.ImageDenylist {
+				// patterns were validated by validateArgs
+				if denied, _ := path.Match(normalizeImage(pattern), normalizeImage(image)); denied {
+					violations = append(violations, fmt.Sprintf(
+						"%s: image '%s' matches '%s'", r.CurId(), image, pattern))
+					break
+				}
+			}
+		}
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf(
+			"helm chart '%s' uses images denied by imageDenylist:\n- %s",
+			p.Name, strings.Join(violations, "\n- "))
+	}
+	return nil
+}
+
+// checkImageDigests returns an error listing every container
+// image that is given by tag, or by neither tag nor digest.
+func (p *HelmChartInflationGeneratorPlugin) checkImageDigests(rm resmap.ResMap) error {
+	var violations []string
+	for _, r := range rm.Resources() {
+		if r.GetKind() == "CustomResourceDefinition" {
+			continue
+		}
+		for _, image := range containerImages(r.YNode(), nil) {
+			if !strings.Contains(image, "@sha256:") {
+				violations = append(violations, fmt.Sprintf(
+					"%s: image '%s' has no digest", r.CurId(), image))
+			}
+		}
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf(
+			"helm chart '%s' uses images by tag, not digest, despite requireImageDigests:\n- %s",
+			p.Name, strings.Join(violations, "\n- "))
+	}
+	return nil
+}
+
+// normalizeImage spells out the registry, docker hub's library
+// repository and the latest tag that an image may leave implicit,
+// e.g. 'nginx' becomes 'docker.io/library/nginx:latest'.
+func normalizeImage(image string) string {
+	registry, name := imageRegistry(image), image
+	if first, rest, found := strings.Cut(image, "/"); found &&
+		(strings.ContainsAny(first, ".:") || first == "localhost") {
+		name = rest
+	}
+	if registry == "docker.io" && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if last := name[strings.LastIndex(name, "/")+1:]; !strings.ContainsAny(last, ":@") {
+		name += ":latest"
+	}
+	return registry + "/" + name
+}
+
+// containerImages appends the images of all the containers
+// found anywhere below the given node to images.
+func containerImages(node *kyaml.Node, images []string) []string {
+	if node.Kind != kyaml.MappingNode {
+		for _, n := range node.Content {
+			images = containerImages(n, images)
+		}
+		return images
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i].Value, node.Content[i+1]
+		if slices.Contains(containerFields, key) && value.Kind == kyaml.SequenceNode {
+			for _, container := range value.Content {
+				if image := kyaml.NewRNode(container).Field("image"); image != nil {
+					images = append(images, image.Value.YNode().Value)
+				}
+			}
+		}
+		images = containerImages(value, images)
+	}
+	return images
+}
+
+// imageRegistry returns the registry an image is pulled from,
+// following the docker convention that the first component of
+// the image's name is a registry only if it looks like a host.
+func imageRegistry(image string) string {
+	first, _, found := strings.Cut(image, "/")
+	if !found || (!strings.ContainsAny(first, ".:") && first != "localhost") {
+		return "docker.io"
+	}
+	return normalizeRegistry(first)
+}
+
+// normalizeRegistry maps the aliases of docker hub to docker.io.
+func normalizeRegistry(registry string) string {
+	if registry == "index.docker.io" || registry == "registry-1.docker.io" {
+		return "docker.io"
+	}
+	return registry
+}
+
+// outputNamespace returns the namespace the generated resources are
+// placed in: TargetNamespace if set, else the release's namespace.
+func (p *HelmChartInflationGeneratorPlugin) outputNamespace() string {
+	if p.TargetNamespace != "" {
+		return p.TargetNamespace
+	}
+	return p.Namespace
+}
+
+// setTargetNamespace moves every namespaced resource to TargetNamespace.
+func (p *HelmChartInflationGeneratorPlugin) setTargetNamespace(rm resmap.ResMap) error {
+	for _, r := range rm.Resources() {
+		if r.GetGvk().IsClusterScoped() {
+			continue
+		}
+		if err := r.SetNamespace(p.TargetNamespace); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkNamespaces returns an error listing every namespaced
+// resource that doesn't set its namespace.
+func (p *HelmChartInflationGeneratorPlugin) checkNamespaces(rm resmap.ResMap) error {
+	var missing []string
+	for _, r := range rm.Resources() {
+		if !r.GetGvk().IsClusterScoped() && r.GetNamespace() == "" {
+			missing = append(missing, r.CurId().String())
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf(
+			"helm chart '%s' produces namespaced resources without a namespace:\n- %s",
+			p.Name, strings.Join(missing, "\n- "))
+	}
+	return nil
+}
+
+// addNamespace puts a Namespace resource for the output namespace
+// ahead of the other resources, unless there's one already.
+func (p *HelmChartInflationGeneratorPlugin) addNamespace(rm resmap.ResMap) error {
+	resources := rm.Resources()
+	for _, r := range resources {
+		if r.GetKind() == "Namespace" && r.GetName() == p.outputNamespace() {
+			return nil
+		}
+	}
+	ns, err := p.h.ResmapFactory().RF().FromMap(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Namespace",
+		"metadata": map[string]interface{}{
+			"name": p.outputNamespace(),
+		},
+	})
 	if err != nil {
 		return err
 	}
-	chValues, err := kyaml.Parse(string(pValues))
-	if err != nil {
-		return errors.WrapPrefixf(err, "could not parse values file into rnode")
+	rm.Clear()
+	for _, r := range append([]*resource.Resource{ns}, resources...) {
+		if err = rm.Append(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hookRank places resources according to their helm hook phase:
+// pre-install and pre-upgrade hooks, then the resources that
+// aren't hooks, then post-install and post-upgrade hooks, and
+// last any other hooks, e.g. tests.
+func hookRank(r *resource.Resource) int {
+	hook, isHook := r.GetAnnotations()["helm.sh/hook"]
+	if !isHook {
+		return 1
+	}
+	phases := strings.Split(hook, ",")
+	for i := range phases {
+		phases[i] = strings.TrimSpace(phases[i])
+	}
+	switch {
+	case slices.Contains(phases, "pre-install") || slices.Contains(phases, "pre-upgrade"):
+		return 0
+	case slices.Contains(phases, "post-install") || slices.Contains(phases, "post-upgrade"):
+		return 2
+	default:
+		return 3
+	}
+}
+
+// orderHooksByWeight moves helm hooks before or after the other
+// resources according to their phase, ordering them by weight and
+// then name like helm runs them.  The other resources keep their order.
+func orderHooksByWeight(rm resmap.ResMap) error {
+	resources := rm.Resources()
+	weight := func(r *resource.Resource) int {
+		w, _ := strconv.Atoi(r.GetAnnotations()["helm.sh/hook-weight"])
+		return w
+	}
+	sort.SliceStable(resources, func(i, j int) bool {
+		ri, rj := hookRank(resources[i]), hookRank(resources[j])
+		if ri != rj {
+			return ri < rj
+		}
+		if ri == 1 {
+			return false
+		}
+		if wi, wj := weight(resources[i]), weight(resources[j]); wi != wj {
+			return wi < wj
+		}
+		return resources[i].GetName() < resources[j].GetName()
+	})
+	// Clear the map and re-add the resources in the sorted order.
+	rm.Clear()
+	for _, r := range resources {
+		if err := rm.Append(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortByKindPriority sorts the resources by the priority of their
+// kind, and then by name.
+func (p *HelmChartInflationGeneratorPlugin) sortByKindPriority(rm resmap.ResMap) error {
+	priority := func(r *resource.Resource) int {
+		if n, ok := p.KindPriority[r.GetKind()]; ok {
+			return n
+		}
+		return defaultKindPriority
+	}
+	resources := rm.Resources()
+	sort.SliceStable(resources, func(i, j int) bool {
+		pi, pj := priority(resources[i]), priority(resources[j])
+		if pi != pj {
+			return pi < pj
+		}
+		return resources[i].GetName() < resources[j].GetName()
+	})
+	// Clear the map and re-add the resources in the sorted order.
+	rm.Clear()
+	for _, r := range resources {
+		if err := rm.Append(r); err != nil {
+			return err
+		}
 	}
-	inlineValues, err := kyaml.FromMap(p.ValuesInline)
+	return nil
+}
+
+// configHash returns a hash of the effective generator config,
+// i.e. the chart args along with the contents of every values
+// file, rather than their paths, which may be machine specific.
+func (p *HelmChartInflationGeneratorPlugin) configHash() (string, error) {
+	chart := p.HelmChart
+	chart.ValuesFile = ""
+	chart.AdditionalValuesFiles = nil
+	// Values taken from the build are hashed along with the rest.
+	chart.ValuesOverlays = p.valuesOverlays()
+	b, err := yaml.Marshal(chart)
 	if err != nil {
-		return errors.WrapPrefixf(err, "could not parse values inline into rnode")
+		return "", errors.WrapPrefixf(err, "could not marshal chart config")
 	}
-	var outValues *kyaml.RNode
-	switch p.ValuesMerge {
-	// Function `merge2.Merge` overrides values in dest with values from src.
-	// To achieve override or merge behavior, we pass parameters in different order.
-	// Object passed as dest will be modified, so we copy it just in case someone
-	// decides to use it after this is called.
-	case valuesMergeOptionOverride:
-		outValues, err = merge2.Merge(inlineValues, chValues.Copy(), kyaml.MergeOptions{})
-	case valuesMergeOptionMerge:
-		outValues, err = merge2.Merge(chValues, inlineValues.Copy(), kyaml.MergeOptions{})
+	h := sha256.New()
+	h.Write(b)
+	if p.ValuesFile != "" {
+		if b, _, err = p.loadValuesFile(p.ValuesFile); err != nil {
+			return "", err
+		}
+		h.Write(b)
 	}
-	if err != nil {
-		return errors.WrapPrefixf(err, "could not merge values")
+	for _, file := range p.AdditionalValuesFiles {
+		if b, err = p.h.Loader().Load(file); err != nil {
+			return "", err
+		}
+		h.Write(b)
 	}
-	mapValues, err := outValues.Map()
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// renderCachePath returns the path in RenderCacheDir of helm's output
+// for the chart at chartPath, named after a hash of the effective
+// generator config, the helm version and the chart's files, so that
+// changing any of them misses the cache.
+func (p *HelmChartInflationGeneratorPlugin) renderCachePath(configHash, chartPath string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\nv3.%d\n", configHash, p.helmMinorVersion)
+	err := filepath.WalkDir(chartPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(chartPath, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s %d\n", filepath.ToSlash(rel), len(b))
+		h.Write(b)
+		return nil
+	})
 	if err != nil {
-		return errors.WrapPrefixf(err, "could not parse merged values into map")
+		return "", errors.WrapPrefixf(err, "could not hash chart for renderCacheDir")
 	}
-	p.ValuesInline = mapValues
-	return err
+	return filepath.Join(p.RenderCacheDir,
+		p.Name+"-"+hex.EncodeToString(h.Sum(nil))+".yaml"), nil
 }
 
-// copyValuesFile to avoid branching.  TODO: get rid of this.
-func (p *HelmChartInflationGeneratorPlugin) copyValuesFile() (string, error) {
-	b, err := p.h.Loader().Load(p.ValuesFile)
+// readRenderCache returns the helm output cached at path,
+// or nil if there's none.
+func readRenderCache(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return b, errors.WrapPrefixf(err, "could not read renderCacheDir")
+}
+
+// writeRenderCache caches helm's output at path, renaming it into
+// place so that concurrent builds never read a partial file.
+func writeRenderCache(path string, stdout []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.WrapPrefixf(err, "could not create renderCacheDir")
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
 	if err != nil {
-		return "", err
+		return errors.WrapPrefixf(err, "could not write renderCacheDir")
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(stdout); err != nil {
+		f.Close()
+		return errors.WrapPrefixf(err, "could not write renderCacheDir")
 	}
-	return p.writeValuesBytes(b)
+	if err = f.Close(); err != nil {
+		return errors.WrapPrefixf(err, "could not write renderCacheDir")
+	}
+	return errors.WrapPrefixf(os.Rename(f.Name(), path), "could not write renderCacheDir")
 }
 
-// Write a absolute path file in the tmp file system.
-func (p *HelmChartInflationGeneratorPlugin) writeValuesBytes(
-	b []byte) (string, error) {
-	if err := p.establishTmpDir(); err != nil {
-		return "", fmt.Errorf("cannot create tmp dir to write helm values")
+// RenderCanonical renders the chart into a canonical YAML stream,
+// i.e. one that doesn't depend on the order in which helm emits
+// resources or their fields, and returns it with its SHA256, e.g.
+// for caches keyed on the output.  Resources are sorted by id, and
+// their fields by name.  Every document ends with a newline, and
+// with ExplicitDocumentStart, starts with '---'.
+func (p *HelmChartInflationGeneratorPlugin) RenderCanonical() ([]byte, string, error) {
+	rm, err := p.Generate()
+	if err != nil {
+		return nil, "", err
 	}
-	path := filepath.Join(p.tmpDir, p.Name+"-kustomize-values.yaml")
-	return path, errors.WrapPrefixf(os.WriteFile(path, b, 0644), "failed to write values file")
+	resources := rm.Resources()
+	sort.SliceStable(resources, func(i, j int) bool {
+		return resources[i].CurId().String() < resources[j].CurId().String()
+	})
+	var out bytes.Buffer
+	for i, r := range resources {
+		m, err := r.Map()
+		if err != nil {
+			return nil, "", err
+		}
+		// Marshaling a map orders the fields by name.
+		b, err := yaml.Marshal(m)
+		if err != nil {
+			return nil, "", err
+		}
+		if i > 0 || p.ExplicitDocumentStart {
+			out.WriteString("---\n")
+		}
+		out.Write(b)
+	}
+	sum := sha256.Sum256(out.Bytes())
+	return out.Bytes(), hex.EncodeToString(sum[:]), nil
 }
 
-func (p *HelmChartInflationGeneratorPlugin) cleanup() {
-	if p.tmpDir != "" {
-		os.RemoveAll(p.tmpDir)
+// RenderCanonicalCompressed is RenderCanonical, but returns the
+// stream gzip-compressed, e.g. for caches of large charts.  The hash
+// is still that of the uncompressed stream, so it's the same key
+// either way.  Decompressing the stream is left to the caller.
+func (p *HelmChartInflationGeneratorPlugin) RenderCanonicalCompressed() ([]byte, string, error) {
+	b, hash, err := p.RenderCanonical()
+	if err != nil {
+		return nil, "", err
+	}
+	var out bytes.Buffer
+	gz := gzip.NewWriter(&out)
+	if _, err = gz.Write(b); err != nil {
+		return nil, "", errors.WrapPrefixf(err, "could not compress rendered chart")
+	}
+	if err = gz.Close(); err != nil {
+		return nil, "", errors.WrapPrefixf(err, "could not compress rendered chart")
 	}
+	return out.Bytes(), hash, nil
 }
 
-// Generate implements generator
-func (p *HelmChartInflationGeneratorPlugin) Generate() (rm resmap.ResMap, err error) {
-	defer p.cleanup()
-	if err = p.checkHelmVersion(); err != nil {
-		return nil, err
+// RenderToDir renders the chart and writes each resource to its
+// own file in dir, named '{namespace}-{kind}-{name}.yaml', or
+// '{kind}-{name}.yaml' for a resource without a namespace, with the
+// kind in lower case.  A relative dir is taken to be relative to the
+// kustomization root.  The dir must exist, and since the loader can't
+// tell whether load restrictions apply, be in or below the root.
+// With EmitKustomization, a kustomization.yaml listing the files is
+// written too.
+func (p *HelmChartInflationGeneratorPlugin) RenderToDir(dir string) error {
+	fSys := filesys.MakeFsOnDisk()
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(p.h.Loader().Root(), dir)
 	}
-	if path, exists := p.chartExistsLocally(); !exists {
-		if p.Repo == "" {
-			return nil, fmt.Errorf(
-				"no repo specified for pull, no chart found at '%s'", path)
+	confirmed, err := filesys.ConfirmDir(fSys, dir)
+	if err != nil {
+		return errors.WrapPrefixf(err, "cannot render to '%s'", dir)
+	}
+	root, err := filesys.ConfirmDir(fSys, p.h.Loader().Root())
+	if err != nil {
+		return err
+	}
+	if !confirmed.HasPrefix(root) {
+		return fmt.Errorf("cannot render to '%s', which is not in or below '%s'", dir, root)
+	}
+	rm, err := p.Generate()
+	if err != nil {
+		return err
+	}
+	rm.RemoveBuildAnnotations()
+	nodes := rm.ToRNodeSlice()
+	var files []string
+	for _, node := range nodes {
+		name := strings.ToLower(node.GetKind()) + "-" + node.GetName() + ".yaml"
+		if namespace := node.GetNamespace(); namespace != "" {
+			name = namespace + "-" + name
 		}
-		if _, err := p.runHelmCommand(p.pullCommand()); err != nil {
-			return nil, err
+		if err = node.PipeE(kyaml.SetAnnotation(kioutil.PathAnnotation, name)); err != nil {
+			return err
+		}
+		if !slices.Contains(files, name) {
+			files = append(files, name)
 		}
 	}
-	if len(p.ValuesInline) > 0 {
-		p.ValuesFile, err = p.createNewMergedValuesFile()
-	} else {
-		p.ValuesFile, err = p.copyValuesFile()
+	if err = (kio.LocalPackageWriter{
+		PackagePath: confirmed.String(),
+		FileSystem:  filesys.FileSystemOrOnDisk{FileSystem: fSys},
+	}.Write(nodes)); err != nil || !p.EmitKustomization {
+		return err
 	}
+	sort.Strings(files)
+	b, err := yaml.Marshal(types.Kustomization{
+		TypeMeta: types.TypeMeta{
+			APIVersion: types.KustomizationVersion,
+			Kind:       types.KustomizationKind,
+		},
+		Resources: files,
+	})
 	if err != nil {
-		return nil, err
+		return err
+	}
+	return fSys.WriteFile(
+		filepath.Join(confirmed.String(), konfig.DefaultKustomizationFileName()), b)
+}
+
+// RenderToStream renders the chart and writes the resources to w as
+// one stream of YAML documents, after all post-processing, and without
+// the annotations kustomize uses internally, e.g. for the output of an
+// Argo CD config management plugin.
+func (p *HelmChartInflationGeneratorPlugin) RenderToStream(w io.Writer) error {
+	rm, err := p.Generate()
+	if err != nil {
+		return err
 	}
-	var stdout []byte
-	stdout, err = p.runHelmCommand(p.AsHelmArgs(p.absChartHome()))
+	rm.RemoveBuildAnnotations()
+	b, err := rm.AsYaml()
 	if err != nil {
-		return nil, err
+		return err
 	}
+	_, err = w.Write(b)
+	return err
+}
 
-	rm, resMapErr := p.h.ResmapFactory().NewResMapFromBytes(stdout)
-	if resMapErr == nil {
-		return rm, nil
+// GenerateAndDiff renders the chart, and compares the result with
+// the previously generated manifests found in DiffAgainst.
+func (p *HelmChartInflationGeneratorPlugin) GenerateAndDiff() (
+	rm resmap.ResMap, changes []resmap.ResourceChange, err error) {
+	if p.DiffAgainst == "" {
+		return nil, nil, fmt.Errorf("diffAgainst must be specified to diff")
 	}
-	// try to remove the contents before first "---" because
-	// helm may produce messages to stdout before it
-	r := &kio.ByteReader{Reader: bytes.NewBufferString(string(stdout)), OmitReaderAnnotations: true}
-	nodes, err := r.Read()
+	b, err := p.h.Loader().Load(p.DiffAgainst)
 	if err != nil {
-		return nil, fmt.Errorf("error reading helm output: %w", err)
+		return nil, nil, errors.WrapPrefixf(err, "could not load diffAgainst")
+	}
+	previous, err := p.h.ResmapFactory().NewResMapFromBytes(b)
+	if err != nil {
+		return nil, nil, errors.WrapPrefixf(err, "could not parse diffAgainst")
+	}
+	if rm, err = p.Generate(); err != nil {
+		return nil, nil, err
+	}
+	if changes, err = resmap.Diff(previous, rm); err != nil {
+		return nil, nil, err
 	}
+	return rm, changes, nil
+}
 
-	if len(nodes) != 0 {
-		rm, err = p.h.ResmapFactory().NewResMapFromRNodeSlice(nodes)
+// DiffKubeVersions renders the chart against each of the two
+// CompareKubeVersions, and returns the resources added, removed and
+// changed going from the first to the second.  Resources are matched
+// by kind, namespace and name, so one whose apiVersion differs is
+// reported as changed.
+func (p *HelmChartInflationGeneratorPlugin) DiffKubeVersions() (changes []resmap.ResourceChange, err error) {
+	if len(p.CompareKubeVersions) == 0 {
+		return nil, fmt.Errorf("compareKubeVersions must be specified to diff")
+	}
+	// Generate rewrites the values files into the tmp dir, so each
+	// render starts from the config, and the tmp dir is kept until
+	// both are done.
+	config := p.HelmChart
+	p.keepTmpDir = true
+	defer func() {
+		p.HelmChart = config
+		p.keepTmpDir = false
+		if err == nil || !p.KeepTmpOnError {
+			p.cleanup()
+		}
+	}()
+	var renders []resmap.ResMap
+	for _, version := range p.CompareKubeVersions {
+		p.HelmChart = config
+		p.KubeVersion = version
+		rm, err := p.Generate()
 		if err != nil {
-			return nil, fmt.Errorf("could not parse rnode slice into resource map: %w", err)
+			return nil, errors.WrapPrefixf(err, "kube version '%s'", version)
 		}
-		return rm, nil
+		renders = append(renders, rm)
+	}
+	return resmap.DiffIgnoringApiVersion(renders[0], renders[1])
+}
+
+// stripPreamble drops anything helm printed to stdout ahead of the
+// first document separator.  Only a separator starting at column
+// zero counts; a "---" indented inside a value, e.g. YAML embedded
+// in a ConfigMap, is document content and is left alone.
+func stripPreamble(b []byte) []byte {
+	loc := docSeparator.FindIndex(b)
+	if loc == nil {
+		return b
+	}
+	return b[loc[0]:]
+}
+
+// GenerateByGroup renders the chart once and partitions the
+// resulting resources into named buckets, keyed by the group
+// names in the argument.  Each group lists the kinds it holds.
+// Resources whose kind isn't listed in any group land in the
+// defaultGroup bucket.
+func (p *HelmChartInflationGeneratorPlugin) GenerateByGroup(
+	groups map[string][]string) (map[string]resmap.ResMap, error) {
+	kindToGroup := make(map[string]string)
+	for group, kinds := range groups {
+		for _, kind := range kinds {
+			if other, ok := kindToGroup[kind]; ok && other != group {
+				return nil, fmt.Errorf(
+					"kind '%s' is listed in both group '%s' and group '%s'",
+					kind, other, group)
+			}
+			kindToGroup[kind] = group
+		}
+	}
+	rm, err := p.Generate()
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]resmap.ResMap{defaultGroup: resmap.New()}
+	for group := range groups {
+		result[group] = resmap.New()
+	}
+	for _, r := range rm.Resources() {
+		group, ok := kindToGroup[r.GetKind()]
+		if !ok {
+			group = defaultGroup
+		}
+		if err = result[group].Append(r); err != nil {
+			return nil, errors.WrapPrefixf(err, "could not add resource to group '%s'", group)
+		}
+	}
+	return result, nil
+}
+
+// pullChart pulls the chart, retrying failed pulls up to PullRetries
+// times.  If the registry rate limited the pull and said when to
+// come back, the next attempt waits that long.
+func (p *HelmChartInflationGeneratorPlugin) pullChart() error {
+	if err := p.downloadKeyring(); err != nil {
+		return err
+	}
+	if err := p.locateHelmPlugins(); err != nil {
+		return err
+	}
+	if err := p.writeCredentials(context.Background()); err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		_, err := p.runHelmCommand(p.pullCommand())
+		if err == nil {
+			return nil
+		}
+		if strings.HasPrefix(p.Repo, "oci://") && wrongMediaType.MatchString(err.Error()) {
+			// Retrying won't change the artifact.
+			return fmt.Errorf(
+				"helm chart '%s' in %s isn't stored as helm expects (%s); "+
+					"helm can't be told to expect another artifact type, so push "+
+					"the chart with 'helm push': %w",
+				p.Name, p.Repo, helmChartMediaTypes, err)
+		}
+		delay := pullRetryDelay
+		if rateLimited.MatchString(err.Error()) {
+			err = types.NewErrRateLimited("pulling helm chart", err)
+			if m := retryAfter.FindStringSubmatch(err.Error()); m != nil {
+				seconds, _ := strconv.Atoi(m[1])
+				delay = time.Duration(seconds) * time.Second
+			}
+		}
+		if attempt >= p.PullRetries {
+			return err
+		}
+		time.Sleep(delay)
 	}
-	return nil, fmt.Errorf("could not parse bytes into resource map: %w", resMapErr)
 }
 
 func (p *HelmChartInflationGeneratorPlugin) pullCommand() []string {
@@ -322,10 +3482,48 @@ func (p *HelmChartInflationGeneratorPlugin) pullCommand() []string {
 		"--untar",
 		"--untardir", p.absChartHome(),
 	}
+	if p.KeepTarball {
+		args = []string{
+			"pull",
+			"--destination", p.absChartHome(),
+		}
+	}
+	if p.keyring != "" {
+		args = append(args, "--verify", "--keyring", p.keyring)
+	}
+	return append(args, p.chartRefArgs()...)
+}
+
+// downloadKeyring fetches the keyring at KeyringURL, if any,
+// into the tmp dir, for pullCommand to pass to helm.
+func (p *HelmChartInflationGeneratorPlugin) downloadKeyring() error {
+	if p.KeyringURL == "" || p.keyring != "" {
+		return nil
+	}
+	b, err := p.load(p.KeyringURL)
+	if err != nil {
+		return errors.WrapPrefixf(err, "could not download keyring")
+	}
+	if err = p.establishTmpDir(); err != nil {
+		return errors.WrapPrefixf(err, "unable to create tmp dir for keyring")
+	}
+	path := filepath.Join(p.tmpDir, "keyring.gpg")
+	if err = os.WriteFile(path, b, 0644); err != nil {
+		return errors.WrapPrefixf(err, "failed to write keyring")
+	}
+	p.keyring = path
+	return nil
+}
 
+// chartRefArgs returns the args by which helm commands
+// such as pull and show locate the chart in its repo.
+func (p *HelmChartInflationGeneratorPlugin) chartRefArgs() []string {
+	var args []string
 	switch {
 	case strings.HasPrefix(p.Repo, "oci://"):
 		args = append(args, strings.TrimSuffix(p.Repo, "/")+"/"+p.Name)
+	case p.repositoryConfig != "":
+		args = append(args, credentialsRepoName+"/"+p.Name)
 	case p.Repo != "":
 		args = append(args, "--repo", p.Repo)
 		fallthrough
@@ -339,14 +3537,259 @@ func (p *HelmChartInflationGeneratorPlugin) pullCommand() []string {
 	return args
 }
 
+// translateHeaders turns the Authorization header of Headers, the only
+// one helm can send, into credentials helm understands: the username
+// and password of a basic header, or, for an oci repo, the token of a
+// bearer header.
+func (p *HelmChartInflationGeneratorPlugin) translateHeaders() error {
+	for name, value := range p.Headers {
+		if strings.EqualFold(name, "User-Agent") {
+			return fmt.Errorf(
+				"helm always sends its own User-Agent, e.g. 'Helm/3.14.2', with no " +
+					"flag or environment variable to change it; a registry that " +
+					"allows only certain agents must allow helm's")
+		}
+		if !strings.EqualFold(name, "Authorization") {
+			return fmt.Errorf(
+				"header '%s' is not supported by helm; only Authorization is", name)
+		}
+		if p.CredentialsSecret != "" {
+			return fmt.Errorf(
+				"headers and credentialsSecret cannot both set the repo's credentials")
+		}
+		scheme, credentials, _ := strings.Cut(value, " ")
+		switch {
+		case strings.EqualFold(scheme, "Basic"):
+			decoded, err := base64.StdEncoding.DecodeString(credentials)
+			if err != nil {
+				return errors.WrapPrefixf(err, "could not decode basic Authorization header")
+			}
+			var found bool
+			if p.username, p.password, found = strings.Cut(string(decoded), ":"); !found {
+				return fmt.Errorf("basic Authorization header has no password")
+			}
+		case strings.EqualFold(scheme, "Bearer"):
+			if !strings.HasPrefix(p.Repo, "oci://") {
+				return fmt.Errorf("a bearer Authorization header requires an oci repo")
+			}
+			p.registryToken = credentials
+		default:
+			return fmt.Errorf("unsupported Authorization header scheme '%s'", scheme)
+		}
+	}
+	return nil
+}
+
+// writeCredentials hands the credentials for the repo, if any, to
+// helm in config files, rather than on its command line, where other
+// users of the host could read them.
+func (p *HelmChartInflationGeneratorPlugin) writeCredentials(ctx context.Context) error {
+	if strings.HasPrefix(p.Repo, "oci://") {
+		return p.writeRegistryConfig()
+	}
+	return p.writeRepositoryConfig(ctx)
+}
+
+// writeRegistryConfig writes a registry config file holding registryToken,
+// or the username and password, for the host of the oci repo.
+func (p *HelmChartInflationGeneratorPlugin) writeRegistryConfig() error {
+	auth := map[string]string{"registrytoken": p.registryToken}
+	switch {
+	case p.username != "":
+		auth = map[string]string{"auth": base64.StdEncoding.EncodeToString(
+			[]byte(p.username + ":" + p.password))}
+	case p.registryToken == "":
+		return nil
+	}
+	host, _, _ := strings.Cut(strings.TrimPrefix(p.Repo, "oci://"), "/")
+	b, err := json.Marshal(map[string]interface{}{
+		"auths": map[string]interface{}{host: auth},
+	})
+	if err != nil {
+		return err
+	}
+	if err = p.establishTmpDir(); err != nil {
+		return errors.WrapPrefixf(err, "unable to create tmp dir for registry config")
+	}
+	path := filepath.Join(p.tmpDir, "registry-config.json")
+	if err = os.WriteFile(path, b, 0600); err != nil {
+		return errors.WrapPrefixf(err, "failed to write registry config")
+	}
+	p.registryConfig = path
+	return nil
+}
+
+// writeRepositoryConfig writes a repository config file naming the
+// repo credentialsRepoName, with the username and password to reach
+// it, if there are any, and fetches the repo's index with them.
+// Helm only takes credentials for a repo given by --repo on its
+// command line.
+func (p *HelmChartInflationGeneratorPlugin) writeRepositoryConfig(ctx context.Context) error {
+	if p.username == "" || p.Repo == "" {
+		return nil
+	}
+	b, err := yaml.Marshal(map[string]interface{}{
+		"apiVersion": "",
+		"repositories": []map[string]string{{
+			"name":     credentialsRepoName,
+			"url":      p.Repo,
+			"username": p.username,
+			"password": p.password,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	if err = p.establishTmpDir(); err != nil {
+		return errors.WrapPrefixf(err, "unable to create tmp dir for repository config")
+	}
+	path := filepath.Join(p.tmpDir, "repositories.yaml")
+	if err = os.WriteFile(path, b, 0600); err != nil {
+		return errors.WrapPrefixf(err, "failed to write repository config")
+	}
+	p.repositoryConfig = path
+	_, _, err = p.runHelmCommandContext(ctx, []string{"repo", "update", credentialsRepoName})
+	return errors.WrapPrefixf(err, "could not fetch the index of %s", p.Repo)
+}
+
+// loadCredentialsSecret decodes the username and password
+// for the repo from the Secret at CredentialsSecret.
+func (p *HelmChartInflationGeneratorPlugin) loadCredentialsSecret() error {
+	// use Load() to enforce root restrictions
+	b, err := p.h.Loader().Load(p.CredentialsSecret)
+	if err != nil {
+		return errors.WrapPrefixf(err, "could not load credentialsSecret")
+	}
+	rm, err := p.h.ResmapFactory().NewResMapFromBytes(b)
+	if err != nil {
+		return errors.WrapPrefixf(err, "could not parse credentialsSecret")
+	}
+	if len(rm.Resources()) != 1 || rm.Resources()[0].GetKind() != "Secret" {
+		return fmt.Errorf(
+			"credentialsSecret '%s' must hold exactly one Secret", p.CredentialsSecret)
+	}
+	data := rm.Resources()[0].GetDataMap()
+	if p.username, err = p.decodeCredential(data, "username"); err != nil {
+		return err
+	}
+	p.password, err = p.decodeCredential(data, "password")
+	return err
+}
+
+// decodeCredential decodes the value of key in the data of CredentialsSecret.
+func (p *HelmChartInflationGeneratorPlugin) decodeCredential(data map[string]string, key string) (string, error) {
+	encoded, ok := data[key]
+	if !ok {
+		return "", fmt.Errorf(
+			"key '%s' not found in credentialsSecret '%s'", key, p.CredentialsSecret)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errors.WrapPrefixf(err,
+			"could not decode '%s' of credentialsSecret '%s'", key, p.CredentialsSecret)
+	}
+	return string(decoded), nil
+}
+
+// locateHelmPlugins makes helm look for plugins where the user
+// installed them, rather than under ConfigHome, if the repo needs
+// a downloader plugin.  Helm knows where that is when run with
+// the user's own environment.  Plugins in PluginsDir replace the
+// user's.
+func (p *HelmChartInflationGeneratorPlugin) locateHelmPlugins() error {
+	if p.helmPlugins != "" {
+		return nil
+	}
+	if p.PluginsDir != "" {
+		return p.linkPluginsDir()
+	}
+	scheme, _, _ := strings.Cut(p.Repo, "://")
+	if !slices.Contains(downloaderSchemes, scheme) || os.Getenv("HELM_PLUGINS") != "" {
+		return nil
+	}
+	out, err := exec.Command(p.helmCommand(), "env", "HELM_PLUGINS").Output()
+	if err != nil {
+		return errors.WrapPrefixf(err,
+			"unable to locate the helm plugins needed for '%s' repos", scheme)
+	}
+	p.helmPlugins = strings.TrimSpace(string(out))
+	return nil
+}
+
+// linkPluginsDir links each plugin in PluginsDir into the
+// plugins dir of HELM_DATA_HOME, and makes helm look there.
+func (p *HelmChartInflationGeneratorPlugin) linkPluginsDir() error {
+	dir := p.PluginsDir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(p.h.Loader().Root(), dir)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return errors.WrapPrefixf(err, "could not read pluginsDir")
+	}
+	plugins := filepath.Join(p.ConfigHome, ".data", "plugins")
+	if err = os.MkdirAll(plugins, 0755); err != nil {
+		return errors.WrapPrefixf(err, "unable to create helm plugins dir")
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		src := filepath.Join(dir, entry.Name())
+		// use Load() to enforce root restrictions
+		if _, err = p.h.Loader().Load(filepath.Join(src, "plugin.yaml")); err != nil {
+			return errors.WrapPrefixf(err, "could not load helm plugin '%s'", entry.Name())
+		}
+		dst := filepath.Join(plugins, entry.Name())
+		if err = os.RemoveAll(dst); err != nil {
+			return err
+		}
+		if err = os.Symlink(src, dst); err != nil {
+			return errors.WrapPrefixf(err, "unable to link helm plugin '%s'", entry.Name())
+		}
+	}
+	p.helmPlugins = plugins
+	return nil
+}
+
+// addEnvironmentValuesFile adds the chart's environment specific
+// values file, if any, ahead of the other additional values files.
+// It must run after the chart has been pulled.
+func (p *HelmChartInflationGeneratorPlugin) addEnvironmentValuesFile() error {
+	if p.Environment == "" {
+		return nil
+	}
+	path := filepath.Join(
+		p.absChartHome(), p.Name, fmt.Sprintf("values-%s.yaml", p.Environment))
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.WrapPrefixf(err, "could not stat environment values file")
+	}
+	// use Load() to enforce root restrictions
+	if _, err := p.h.Loader().Load(path); err != nil {
+		return errors.WrapPrefixf(err, "could not load environment values file")
+	}
+	p.AdditionalValuesFiles = append([]string{path}, p.AdditionalValuesFiles...)
+	return nil
+}
+
 // chartExistsLocally will return true if the chart does exist in
-// local chart home.
+// local chart home, and, given a PullTTL, is not stale.
 func (p *HelmChartInflationGeneratorPlugin) chartExistsLocally() (string, bool) {
 	path := filepath.Join(p.absChartHome(), p.Name)
 	s, err := os.Stat(path)
 	if err != nil {
 		return "", false
 	}
+	if p.PullTTL != "" && p.Repo != "" {
+		// A chart older than the TTL is as good as missing.
+		ttl, _ := time.ParseDuration(p.PullTTL)
+		if time.Since(s.ModTime()) > ttl {
+			return path, false
+		}
+	}
 	return path, s.IsDir()
 }
 
@@ -356,11 +3799,21 @@ func (p *HelmChartInflationGeneratorPlugin) checkHelmVersion() error {
 	if err != nil {
 		return err
 	}
-	r, err := regexp.Compile(`v?\d+(\.\d+)+`)
+	pattern := `v?\d+(\.\d+)+`
+	if p.HelmVersionRegex != "" {
+		pattern = p.HelmVersionRegex
+	}
+	r, err := regexp.Compile(pattern)
 	if err != nil {
 		return err
 	}
-	v := r.FindString(string(stdout))
+	var v string
+	if m := r.FindStringSubmatch(string(stdout)); m != nil {
+		v = m[0]
+		if i := r.SubexpIndex("version"); i >= 0 {
+			v = m[i]
+		}
+	}
 	if v == "" {
 		return fmt.Errorf("cannot find version string in %s", string(stdout))
 	}
@@ -371,9 +3824,92 @@ func (p *HelmChartInflationGeneratorPlugin) checkHelmVersion() error {
 	if majorVersion != "3" {
 		return fmt.Errorf("this plugin requires helm V3 but got v%s", v)
 	}
+	p.helmMinorVersion, _ = strconv.Atoi(strings.Split(v+".0", ".")[1])
+	if p.helmMinorVersion < explicitCRDsMinorVersion {
+		return fmt.Errorf("helm v%s has no --include-crds and --skip-crds flags "+
+			"for template, so whether it renders CRDs can't be made explicit; "+
+			"this plugin requires helm v3.%d.0 or later", v, explicitCRDsMinorVersion)
+	}
+	// Options mapping to flags that older versions of helm V3 reject,
+	// with the first minor version that has the flag.
+	for _, opt := range []struct {
+		name         string
+		used         bool
+		minorVersion int
+	}{
+		{"setJSONValues", len(p.SetJSONValues) > 0, 10},
+		{"helmLabels", len(p.HelmLabels) > 0, 13},
+		{"skipSchemaValidation", p.SkipSchemaValidation, 16},
+	} {
+		if opt.used && p.helmMinorVersion < opt.minorVersion {
+			return fmt.Errorf("%s requires helm v3.%d.0 or later but got v%s",
+				opt.name, opt.minorVersion, v)
+		}
+	}
+	return nil
+}
+
+// Preflight checks that the environment is set up to generate
+// the chart, without rendering it: helm is installed and is V3,
+// ConfigHome is writable, and, if the chart comes from a repo,
+// the repo is reachable and accepts helm's credentials, within
+// defaultPreflightTimeout.  All failed checks are reported together.
+func (p *HelmChartInflationGeneratorPlugin) Preflight() error {
+	var problems []string
+	helmErr := p.checkHelmVersion()
+	if helmErr != nil {
+		problems = append(problems, "helm: "+helmErr.Error())
+	}
+	if err := p.checkConfigHomeWritable(); err != nil {
+		problems = append(problems, "configHome: "+err.Error())
+	}
+	// Without a usable helm, there's no way to reach the repo.
+	if p.Repo != "" && helmErr == nil {
+		if err := p.locateHelmPlugins(); err != nil {
+			problems = append(problems, "helm: "+err.Error())
+		}
+		// Fetching the chart's metadata exercises both the
+		// network and the credentials, like a pull would.
+		timeout := defaultPreflightTimeout
+		if p.preflightTimeout > 0 {
+			timeout = p.preflightTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		err := p.writeCredentials(ctx)
+		if err == nil {
+			_, _, err = p.runHelmCommandContext(ctx,
+				append([]string{"show", "chart"}, p.chartRefArgs()...))
+		}
+		switch {
+		case err == nil:
+		case unauthorized.MatchString(err.Error()):
+			problems = append(problems, "auth: access to "+p.Repo+" denied: "+err.Error())
+		default:
+			problems = append(problems, "repo: "+p.Repo+" unreachable: "+err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("helm chart '%s' failed preflight checks:\n- %s",
+			p.Name, strings.Join(problems, "\n- "))
+	}
 	return nil
 }
 
+// checkConfigHomeWritable creates ConfigHome if need be,
+// and checks that helm will be able to write files there.
+func (p *HelmChartInflationGeneratorPlugin) checkConfigHomeWritable() error {
+	if err := os.MkdirAll(p.ConfigHome, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(p.ConfigHome, "preflight-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
 func NewHelmChartInflationGeneratorPlugin() resmap.GeneratorPlugin {
 	return &HelmChartInflationGeneratorPlugin{}
 }
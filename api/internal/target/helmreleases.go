@@ -0,0 +1,169 @@
+// Copyright 2024 The Kubernetes Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package target
+
+import (
+	"fmt"
+
+	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/api/resource"
+	"sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/errors"
+)
+
+// helmReleasesGenerator renders several releases of the same
+// helm chart and merges the results.
+type helmReleasesGenerator struct {
+	chart      string
+	releases   []string
+	generators []resmap.Generator
+}
+
+var _ resmap.Generator = &helmReleasesGenerator{}
+
+// buildResourcesUser is a generator that needs the resources
+// generated earlier in the build, e.g. to take values from them.
+type buildResourcesUser interface {
+	SetBuildResources(rm resmap.ResMap)
+}
+
+// buildVarsUser is a generator that needs the vars
+// declared in the build, e.g. to take values from them.
+type buildVarsUser interface {
+	SetBuildVars(vars []types.Var)
+}
+
+// Generate runs the member generators in order, relying on the
+// release names to keep the resources they produce distinct.
+// Any resource produced by more than one release is reported
+// along with the releases that produced it.
+func (g *helmReleasesGenerator) Generate() (resmap.ResMap, error) {
+	return generateHelmCharts([]*helmReleasesGenerator{g})
+}
+
+// SetBuildResources passes the resources of the build so far
+// to the member generators.
+func (g *helmReleasesGenerator) SetBuildResources(rm resmap.ResMap) {
+	for _, gen := range g.generators {
+		if user, ok := gen.(buildResourcesUser); ok {
+			user.SetBuildResources(rm)
+		}
+	}
+}
+
+// SetBuildVars passes the vars declared in the
+// build to the member generators.
+func (g *helmReleasesGenerator) SetBuildVars(vars []types.Var) {
+	for _, gen := range g.generators {
+		if user, ok := gen.(buildVarsUser); ok {
+			user.SetBuildVars(vars)
+		}
+	}
+}
+
+// helmChartsGenerator renders several helm charts and
+// merges the results.
+type helmChartsGenerator struct {
+	charts []*helmReleasesGenerator
+}
+
+var _ resmap.Generator = &helmChartsGenerator{}
+
+// Generate renders the charts in order.  Any resource produced by
+// more than one chart is reported along with the charts that
+// produced it, before the results are merged, rather than left to
+// fail the merge as an unexplained id collision.
+func (g *helmChartsGenerator) Generate() (resmap.ResMap, error) {
+	return generateHelmCharts(g.charts)
+}
+
+// SetBuildResources passes the resources of
+// the build so far to the charts' generators.
+func (g *helmChartsGenerator) SetBuildResources(rm resmap.ResMap) {
+	for _, chart := range g.charts {
+		chart.SetBuildResources(rm)
+	}
+}
+
+// defaultHelmReleaseName stands in for the name of a release
+// whose releaseName is left for helm to generate.
+const defaultHelmReleaseName = "RELEASE-NAME"
+
+// helmReleaseName names a release of a chart in reports,
+// qualified by its namespace if it has one.
+func helmReleaseName(chart types.HelmChart) string {
+	name := chart.ReleaseName
+	if name == "" {
+		name = defaultHelmReleaseName
+	}
+	if chart.Namespace != "" {
+		return chart.Namespace + "/" + name
+	}
+	return name
+}
+
+// SetBuildVars passes the vars declared in
+// the build to the charts' generators.
+func (g *helmChartsGenerator) SetBuildVars(vars []types.Var) {
+	for _, chart := range g.charts {
+		chart.SetBuildVars(vars)
+	}
+}
+
+// helmRelease identifies the release of a chart
+// that produced a resource.
+type helmRelease struct {
+	chart *helmReleasesGenerator
+	index int
+}
+
+func (r helmRelease) String() string {
+	if len(r.chart.generators) == 1 {
+		return fmt.Sprintf("helm chart '%s'", r.chart.chart)
+	}
+	return fmt.Sprintf("release '%s' of helm chart '%s'",
+		r.chart.releases[r.index], r.chart.chart)
+}
+
+// generateHelmCharts runs the generators of the releases of the
+// charts in order, and merges the results, failing on any resource
+// produced by more than one release.
+func generateHelmCharts(charts []*helmReleasesGenerator) (resmap.ResMap, error) {
+	result := resmap.New()
+	producedBy := make(map[*resource.Resource]helmRelease)
+	for _, chart := range charts {
+		for i, gen := range chart.generators {
+			release := helmRelease{chart: chart, index: i}
+			rm, err := gen.Generate()
+			if err != nil {
+				if len(chart.generators) == 1 {
+					return nil, err
+				}
+				return nil, errors.WrapPrefixf(err, "%s", release)
+			}
+			for _, r := range rm.Resources() {
+				matches := result.GetMatchingResourcesByCurrentId(r.CurId().Equals)
+				if len(matches) == 0 {
+					producedBy[r] = release
+					continue
+				}
+				other := producedBy[matches[0]]
+				if other.chart == chart {
+					return nil, fmt.Errorf(
+						"releases '%s' and '%s' of helm chart '%s' both produce %s; "+
+							"use values that give their resources distinct names",
+						chart.releases[other.index], chart.releases[i], chart.chart, r.CurId())
+				}
+				return nil, fmt.Errorf(
+					"%s and %s both produce %s; "+
+						"a resource can only come from one of the helm charts",
+					other, release, r.CurId())
+			}
+			if err = result.AppendAll(rm); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"slices"
 	"strings"
 
 	"sigs.k8s.io/kustomize/api/ifc"
@@ -278,6 +279,16 @@ func (kt *KustTarget) runGenerators(
 	}
 	generators = append(generators, gs...)
 	for i, g := range generators {
+		// Generators taking values from what the build has made
+		// so far, e.g. from ConfigMaps, are given those resources.
+		if user, ok := g.Generator.(buildResourcesUser); ok {
+			user.SetBuildResources(ra.ResMap())
+		}
+		// Those taking values from vars are given the vars declared
+		// so far, those of bases along with this kustomization's own.
+		if user, ok := g.Generator.(buildVarsUser); ok {
+			user.SetBuildVars(slices.Concat(ra.Vars(), kt.kustomization.Vars))
+		}
 		resMap, err := g.Generate()
 		if err != nil {
 			return err
@@ -163,6 +163,20 @@ var generatorConfigurators = map[builtinhelpers.BuiltinPluginType]func(
 		if kt.kustomization.HelmGlobals != nil {
 			globals = *kt.kustomization.HelmGlobals
 		}
+		// The same chart may be listed more than once, to install
+		// several releases of it.  Those releases are rendered by a
+		// single generator, so that collisions between them can be
+		// reported in terms of release names.  As in helm, a release
+		// name need only be unique within its namespace, and one left
+		// empty is generated, so is never a duplicate.
+		type chartKey struct{ name, repo string }
+		type releaseKey struct {
+			chart                  chartKey
+			namespace, releaseName string
+		}
+		releasesOf := make(map[chartKey]*helmReleasesGenerator)
+		listed := make(map[releaseKey]bool)
+		var charts []*helmReleasesGenerator
 		for _, chart := range kt.kustomization.HelmCharts {
 			c.HelmGlobals = globals
 			c.HelmChart = chart
@@ -170,7 +184,37 @@ var generatorConfigurators = map[builtinhelpers.BuiltinPluginType]func(
 			if err = kt.configureBuiltinPlugin(p, c, bpt); err != nil {
 				return nil, err
 			}
-			result = append(result, p)
+			key := chartKey{name: chart.Name, repo: chart.Repo}
+			g, ok := releasesOf[key]
+			if !ok {
+				g = &helmReleasesGenerator{chart: chart.Name}
+				releasesOf[key] = g
+				charts = append(charts, g)
+			}
+			if chart.ReleaseName != "" {
+				rk := releaseKey{chart: key, namespace: chart.Namespace, releaseName: chart.ReleaseName}
+				if listed[rk] {
+					return nil, fmt.Errorf(
+						"helm chart '%s' is listed more than once with releaseName '%s' "+
+							"in namespace '%s'; each release of a chart in a namespace "+
+							"needs a distinct releaseName",
+						chart.Name, chart.ReleaseName, chart.Namespace)
+				}
+				listed[rk] = true
+			}
+			g.releases = append(g.releases, helmReleaseName(chart))
+			g.generators = append(g.generators, p)
+		}
+		switch {
+		case len(charts) > 1:
+			// Rendered together, so that a resource produced by
+			// more than one chart can be reported in terms of charts.
+			result = append(result, &helmChartsGenerator{charts: charts})
+		case len(charts) == 1 && len(charts[0].generators) == 1:
+			// A chart listed once needs no wrapping.
+			result = append(result, charts[0].generators[0])
+		case len(charts) == 1:
+			result = append(result, charts[0])
 		}
 		return
 	},
@@ -896,3 +896,397 @@ func copyValuesFilesTestChartsIntoHarness(t *testing.T, th *kusttest_test.Harnes
 	require.NoError(t, fs.MkdirAll(filepath.Join(thDir, "templates")))
 	require.NoError(t, copyutil.CopyDir(th.GetFSys(), chartDir, thDir))
 }
+
+func TestHelmChartInflationGeneratorMultipleReleasesSameChart(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t)
+	defer th.Reset()
+	if err := th.ErrIfNoHelm(); err != nil {
+		t.Skip("skipping: " + err.Error())
+	}
+
+	copyValuesFilesTestChartsIntoHarness(t, th)
+
+	th.WriteK(th.GetRoot(), `
+helmCharts:
+  - name: test-chart
+    releaseName: tenant-a
+    skipHooks: true
+    valuesInline:
+      data:
+        namespace: tenant-a
+  - name: test-chart
+    releaseName: tenant-b
+    skipHooks: true
+    valuesInline:
+      data:
+        namespace: tenant-b
+`)
+
+	m := th.Run(th.GetRoot(), th.MakeOptionsPluginsEnabled())
+	asYaml, err := m.AsYaml()
+	require.NoError(t, err)
+	require.Equal(t, `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    chart: test-1.0.0
+  name: my-deploy
+  namespace: tenant-a
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app: test
+  template:
+    spec:
+      containers:
+      - image: test-image:v1.0.0
+        imagePullPolicy: Always
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    chart: test-1.0.0
+  name: my-deploy
+  namespace: tenant-b
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app: test
+  template:
+    spec:
+      containers:
+      - image: test-image:v1.0.0
+        imagePullPolicy: Always
+`, string(asYaml))
+}
+
+func TestHelmChartInflationGeneratorValuesFromConfigMaps(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t)
+	defer th.Reset()
+	if err := th.ErrIfNoHelm(); err != nil {
+		t.Skip("skipping: " + err.Error())
+	}
+
+	copyValuesFilesTestChartsIntoHarness(t, th)
+
+	th.WriteF(filepath.Join(th.GetRoot(), "tag-values.yaml"), `
+data:
+  namespace: tenant-a
+  image:
+    tag: v2.0.0
+`)
+	th.WriteK(th.GetRoot(), `
+configMapGenerator:
+  - name: chart-values
+    files:
+      - values.yaml=tag-values.yaml
+helmCharts:
+  - name: test-chart
+    releaseName: test
+    skipHooks: true
+    valuesInline:
+      data:
+        namespace: default
+        image:
+          imagePullPolicy: IfNotPresent
+    valuesFromConfigMaps:
+      - name: chart-values
+        key: values.yaml
+`)
+
+	m := th.Run(th.GetRoot(), th.MakeOptionsPluginsEnabled())
+	asYaml, err := m.AsYaml()
+	require.NoError(t, err)
+	require.Equal(t, `apiVersion: v1
+data:
+  values.yaml: |2
+
+    data:
+      namespace: tenant-a
+      image:
+        tag: v2.0.0
+kind: ConfigMap
+metadata:
+  name: chart-values-k9md5h7788
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    chart: test-1.0.0
+  name: my-deploy
+  namespace: tenant-a
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app: test
+  template:
+    spec:
+      containers:
+      - image: test-image:v2.0.0
+        imagePullPolicy: IfNotPresent
+`, string(asYaml))
+}
+
+func TestHelmChartInflationGeneratorVarReferences(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t)
+	defer th.Reset()
+	if err := th.ErrIfNoHelm(); err != nil {
+		t.Skip("skipping: " + err.Error())
+	}
+
+	copyValuesFilesTestChartsIntoHarness(t, th)
+
+	th.WriteF(filepath.Join(th.GetRoot(), "release.yaml"), `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: release
+data:
+  tag: v3.0.0
+`)
+	th.WriteK(th.GetRoot(), `
+resources:
+  - release.yaml
+vars:
+  - name: IMAGE_TAG
+    objref:
+      apiVersion: v1
+      kind: ConfigMap
+      name: release
+    fieldref:
+      fieldPath: data.tag
+helmCharts:
+  - name: test-chart
+    releaseName: test
+    skipHooks: true
+    varReferences:
+      data.image.tag: IMAGE_TAG
+`)
+
+	m := th.Run(th.GetRoot(), th.MakeOptionsPluginsEnabled())
+	asYaml, err := m.AsYaml()
+	require.NoError(t, err)
+	require.Equal(t, `apiVersion: v1
+data:
+  tag: v3.0.0
+kind: ConfigMap
+metadata:
+  name: release
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    chart: test-1.0.0
+  name: my-deploy
+  namespace: default
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app: test
+  template:
+    spec:
+      containers:
+      - image: test-image:v3.0.0
+        imagePullPolicy: Always
+`, string(asYaml))
+
+	th.WriteK(th.GetRoot(), `
+resources:
+  - release.yaml
+helmCharts:
+  - name: test-chart
+    releaseName: test
+    skipHooks: true
+    varReferences:
+      data.image.tag: IMAGE_TAG
+`)
+	err = th.RunWithErr(th.GetRoot(), th.MakeOptionsPluginsEnabled())
+	require.Error(t, err)
+	require.Contains(t, err.Error(),
+		"varReferences 'data.image.tag': var 'IMAGE_TAG' is not declared in the build")
+}
+
+func TestHelmChartInflationGeneratorMultipleReleasesSameChartCollision(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t)
+	defer th.Reset()
+	if err := th.ErrIfNoHelm(); err != nil {
+		t.Skip("skipping: " + err.Error())
+	}
+
+	copyValuesFilesTestChartsIntoHarness(t, th)
+
+	// The chart doesn't derive the Deployment's name or
+	// namespace from the release name.
+	th.WriteK(th.GetRoot(), `
+helmCharts:
+  - name: test-chart
+    releaseName: tenant-a
+    skipHooks: true
+  - name: test-chart
+    releaseName: tenant-b
+    skipHooks: true
+`)
+
+	err := th.RunWithErr(th.GetRoot(), th.MakeOptionsPluginsEnabled())
+	require.Error(t, err)
+	require.Contains(t, err.Error(),
+		"releases 'tenant-a' and 'tenant-b' of helm chart 'test-chart' both produce Deployment.v1.apps/my-deploy.default")
+}
+
+func TestHelmChartInflationGeneratorMultipleChartsCollision(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t)
+	defer th.Reset()
+	if err := th.ErrIfNoHelm(); err != nil {
+		t.Skip("skipping: " + err.Error())
+	}
+
+	th.MkDir("charts")
+	for _, chart := range []string{"frontend", "backend"} {
+		dir := th.MkDir(filepath.Join("charts", chart))
+		th.MkDir(filepath.Join("charts", chart, "templates"))
+		th.WriteF(filepath.Join(dir, "Chart.yaml"), `
+apiVersion: v2
+name: `+chart+`
+version: 1.0.0
+`)
+		th.WriteF(filepath.Join(dir, "values.yaml"), "")
+		th.WriteF(filepath.Join(dir, "templates", "configmap.yaml"), `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: shared-config
+data:
+  chart: `+chart+`
+`)
+	}
+	th.WriteK(th.GetRoot(), `
+helmCharts:
+  - name: frontend
+    releaseName: frontend
+  - name: backend
+    releaseName: backend
+`)
+
+	err := th.RunWithErr(th.GetRoot(), th.MakeOptionsPluginsEnabled())
+	require.Error(t, err)
+	require.Contains(t, err.Error(),
+		"helm chart 'frontend' and helm chart 'backend' both produce ConfigMap.v1.[noGrp]/shared-config.[noNs]; "+
+			"a resource can only come from one of the helm charts")
+}
+
+func TestHelmChartInflationGeneratorSameReleaseNameInTwoNamespaces(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t)
+	defer th.Reset()
+	if err := th.ErrIfNoHelm(); err != nil {
+		t.Skip("skipping: " + err.Error())
+	}
+
+	copyValuesFilesTestChartsIntoHarness(t, th)
+
+	expected := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    chart: test-1.0.0
+  name: my-deploy
+  namespace: tenant-a
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app: test
+  template:
+    spec:
+      containers:
+      - image: test-image:v1.0.0
+        imagePullPolicy: Always
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    chart: test-1.0.0
+  name: my-deploy
+  namespace: tenant-b
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app: test
+  template:
+    spec:
+      containers:
+      - image: test-image:v1.0.0
+        imagePullPolicy: Always
+`
+	th.WriteK(th.GetRoot(), `
+helmCharts:
+  - name: test-chart
+    releaseName: app
+    namespace: tenant-a
+    skipHooks: true
+    valuesInline:
+      data:
+        namespace: tenant-a
+  - name: test-chart
+    releaseName: app
+    namespace: tenant-b
+    skipHooks: true
+    valuesInline:
+      data:
+        namespace: tenant-b
+`)
+	m := th.Run(th.GetRoot(), th.MakeOptionsPluginsEnabled())
+	asYaml, err := m.AsYaml()
+	require.NoError(t, err)
+	require.Equal(t, expected, string(asYaml))
+
+	// Release names left for helm to generate are never duplicates.
+	th.WriteK(th.GetRoot(), `
+helmCharts:
+  - name: test-chart
+    skipHooks: true
+    valuesInline:
+      data:
+        namespace: tenant-a
+  - name: test-chart
+    skipHooks: true
+    valuesInline:
+      data:
+        namespace: tenant-b
+`)
+	m = th.Run(th.GetRoot(), th.MakeOptionsPluginsEnabled())
+	asYaml, err = m.AsYaml()
+	require.NoError(t, err)
+	require.Equal(t, expected, string(asYaml))
+}
+
+func TestHelmChartInflationGeneratorDuplicateReleaseName(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t)
+	defer th.Reset()
+	if err := th.ErrIfNoHelm(); err != nil {
+		t.Skip("skipping: " + err.Error())
+	}
+
+	copyValuesFilesTestChartsIntoHarness(t, th)
+
+	th.WriteK(th.GetRoot(), `
+helmCharts:
+  - name: test-chart
+    releaseName: tenant-a
+  - name: test-chart
+    releaseName: tenant-a
+`)
+
+	err := th.RunWithErr(th.GetRoot(), th.MakeOptionsPluginsEnabled())
+	require.Error(t, err)
+	require.Contains(t, err.Error(),
+		"helm chart 'test-chart' is listed more than once with releaseName 'tenant-a'")
+}
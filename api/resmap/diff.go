@@ -0,0 +1,106 @@
+// Copyright 2024 The Kubernetes Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package resmap
+
+import (
+	"bytes"
+	"fmt"
+
+	"sigs.k8s.io/kustomize/api/resource"
+	"sigs.k8s.io/kustomize/kyaml/resid"
+)
+
+// ChangeType says how a resource differs between two ResMaps.
+type ChangeType string
+
+const (
+	ChangeAdded   ChangeType = "added"
+	ChangeRemoved ChangeType = "removed"
+	ChangeChanged ChangeType = "changed"
+)
+
+// ResourceChange describes a resource that differs between two ResMaps.
+type ResourceChange struct {
+	Id   resid.ResId
+	Type ChangeType
+}
+
+// Diff compares two ResMaps by resource id, and returns the resources
+// added to, changed in, and removed from oldMap to get newMap.  Added
+// and changed resources are listed first, in the order of newMap,
+// followed by removed resources in the order of oldMap.
+func Diff(oldMap, newMap ResMap) ([]ResourceChange, error) {
+	return diff(oldMap, newMap, resid.ResId.Equals)
+}
+
+// DiffIgnoringApiVersion is like Diff, but matches resources by kind,
+// namespace and name only, so that a resource whose apiVersion differs
+// between the ResMaps, e.g. an Ingress moving from extensions/v1beta1
+// to networking.k8s.io/v1, is reported as changed, rather than as
+// removed and added.
+func DiffIgnoringApiVersion(oldMap, newMap ResMap) ([]ResourceChange, error) {
+	return diff(oldMap, newMap, func(a, b resid.ResId) bool {
+		return a.Kind == b.Kind && a.Name == b.Name && a.IsNsEquals(b)
+	})
+}
+
+func diff(oldMap, newMap ResMap, equals func(a, b resid.ResId) bool) ([]ResourceChange, error) {
+	var result []ResourceChange
+	for _, r := range newMap.Resources() {
+		old, err := matchingResource(oldMap, r, equals)
+		if err != nil {
+			return nil, err
+		}
+		if old == nil {
+			result = append(result, ResourceChange{Id: r.CurId(), Type: ChangeAdded})
+			continue
+		}
+		same, err := sameYaml(old, r)
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			result = append(result, ResourceChange{Id: r.CurId(), Type: ChangeChanged})
+		}
+	}
+	for _, r := range oldMap.Resources() {
+		current, err := matchingResource(newMap, r, equals)
+		if err != nil {
+			return nil, err
+		}
+		if current == nil {
+			result = append(result, ResourceChange{Id: r.CurId(), Type: ChangeRemoved})
+		}
+	}
+	return result, nil
+}
+
+// matchingResource returns the resource in m whose current id
+// equals that of r, or nil if there's no such resource.
+func matchingResource(
+	m ResMap, r *resource.Resource, equals func(a, b resid.ResId) bool) (*resource.Resource, error) {
+	matches := m.GetMatchingResourcesByCurrentId(func(id resid.ResId) bool {
+		return equals(r.CurId(), id)
+	})
+	switch len(matches) {
+	case 0:
+		return nil, nil
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, fmt.Errorf("multiple matches for Current %s", r.CurId())
+	}
+}
+
+func sameYaml(a, b *resource.Resource) (bool, error) {
+	aYaml, err := a.AsYAML()
+	if err != nil {
+		return false, err
+	}
+	bYaml, err := b.AsYAML()
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(aYaml, bYaml), nil
+}
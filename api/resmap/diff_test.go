@@ -0,0 +1,128 @@
+// Copyright 2024 The Kubernetes Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package resmap_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	. "sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/kyaml/resid"
+)
+
+func TestDiff(t *testing.T) {
+	oldMap, err := rmF.NewResMapFromBytes([]byte(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: unchanged
+data:
+  a: "1"
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: changed
+data:
+  a: "1"
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: removed
+`))
+	require.NoError(t, err)
+	newMap, err := rmF.NewResMapFromBytes([]byte(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: added
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: changed
+data:
+  a: "2"
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: unchanged
+data:
+  a: "1"
+`))
+	require.NoError(t, err)
+
+	changes, err := Diff(oldMap, newMap)
+	require.NoError(t, err)
+	assert.Equal(t, []ResourceChange{
+		{
+			Id:   resid.NewResId(resid.NewGvk("apps", "v1", "Deployment"), "added"),
+			Type: ChangeAdded,
+		},
+		{
+			Id:   resid.NewResId(resid.NewGvk("", "v1", "ConfigMap"), "changed"),
+			Type: ChangeChanged,
+		},
+		{
+			Id:   resid.NewResId(resid.NewGvk("", "v1", "Service"), "removed"),
+			Type: ChangeRemoved,
+		},
+	}, changes)
+
+	changes, err = Diff(oldMap, oldMap)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+}
+
+func TestDiffIgnoringApiVersion(t *testing.T) {
+	oldMap, err := rmF.NewResMapFromBytes([]byte(`
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: web
+---
+apiVersion: policy/v1
+kind: PodDisruptionBudget
+metadata:
+  name: web
+`))
+	require.NoError(t, err)
+	newMap, err := rmF.NewResMapFromBytes([]byte(`
+apiVersion: networking.k8s.io/v1
+kind: Ingress
+metadata:
+  name: web
+---
+apiVersion: policy/v1
+kind: PodDisruptionBudget
+metadata:
+  name: web
+`))
+	require.NoError(t, err)
+
+	changes, err := DiffIgnoringApiVersion(oldMap, newMap)
+	require.NoError(t, err)
+	assert.Equal(t, []ResourceChange{
+		{
+			Id:   resid.NewResId(resid.NewGvk("networking.k8s.io", "v1", "Ingress"), "web"),
+			Type: ChangeChanged,
+		},
+	}, changes)
+
+	changes, err = Diff(oldMap, newMap)
+	require.NoError(t, err)
+	assert.Equal(t, []ResourceChange{
+		{
+			Id:   resid.NewResId(resid.NewGvk("networking.k8s.io", "v1", "Ingress"), "web"),
+			Type: ChangeAdded,
+		},
+		{
+			Id:   resid.NewResId(resid.NewGvk("extensions", "v1beta1", "Ingress"), "web"),
+			Type: ChangeRemoved,
+		},
+	}, changes)
+}
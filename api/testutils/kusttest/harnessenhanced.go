@@ -158,20 +158,39 @@ func (th *HarnessEnhanced) LoadAndRunGenerator(
 
 func (th *HarnessEnhanced) LoadAndRunGeneratorWithBuildAnnotations(
 	config string) resmap.ResMap {
-	res, err := th.rf.RF().FromBytes([]byte(config))
+	rm, err := th.LoadGenerator(config).Generate()
 	if err != nil {
-		th.t.Fatalf("Err: %v", err)
+		th.t.Fatalf("generate err: %v", err)
 	}
-	g, err := th.pl.LoadGenerator(
-		th.ldr, valtest_test.MakeFakeValidator(), res)
+	return rm
+}
+
+// LoadGenerator loads and configures a generator without running it,
+// for tests that need to call methods beyond Generate.
+func (th *HarnessEnhanced) LoadGenerator(
+	config string) resmap.Generator {
+	g, err := th.loadGenerator(config)
 	if err != nil {
 		th.t.Fatalf("Err: %v", err)
 	}
-	rm, err := g.Generate()
+	return g
+}
+
+// ErrorFromLoadGenerator returns the error from loading and
+// configuring a generator, for tests of invalid configs.
+func (th *HarnessEnhanced) ErrorFromLoadGenerator(config string) error {
+	_, err := th.loadGenerator(config)
+	return err
+}
+
+func (th *HarnessEnhanced) loadGenerator(
+	config string) (resmap.Generator, error) {
+	res, err := th.rf.RF().FromBytes([]byte(config))
 	if err != nil {
-		th.t.Fatalf("generate err: %v", err)
+		th.t.Fatalf("Err: %v", err)
 	}
-	return rm
+	return th.pl.LoadGenerator(
+		th.ldr, valtest_test.MakeFakeValidator(), res)
 }
 
 func (th *HarnessEnhanced) LoadAndRunTransformer(
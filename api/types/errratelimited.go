@@ -0,0 +1,35 @@
+// Copyright 2024 The Kubernetes Authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package types
+
+import (
+	"fmt"
+
+	"sigs.k8s.io/kustomize/kyaml/errors"
+)
+
+// errRateLimited reports that a remote registry or repository
+// refused a request because too many requests were made.
+type errRateLimited struct {
+	// What was rate limited?
+	what string
+	err  error
+}
+
+func (e *errRateLimited) Error() string {
+	return fmt.Sprintf("rate limited while %s: %v", e.what, e.err)
+}
+
+func (e *errRateLimited) Unwrap() error {
+	return e.err
+}
+
+func NewErrRateLimited(w string, err error) *errRateLimited {
+	return &errRateLimited{what: w, err: err}
+}
+
+func IsErrRateLimited(err error) bool {
+	e := &errRateLimited{}
+	return errors.As(err, &e)
+}
@@ -3,7 +3,13 @@
 
 package types
 
-import "path/filepath"
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+)
 
 const HelmDefaultHome = "charts"
 
@@ -32,6 +38,26 @@ type HelmGlobals struct {
 	//   HELM_DATA_HOME={ConfigHome}/.data
 	// for the helm subprocess.
 	ConfigHome string `json:"configHome,omitempty" yaml:"configHome,omitempty"`
+
+	// CacheDir, if set, replaces {tmpDir} above with a directory below
+	// CacheDir named after a hash of the chart's config, and keeps it
+	// after the build, so that identical builds reuse what helm stored
+	// there.  Builds using the same directory take turns, by way of a
+	// lock file next to it.
+	CacheDir string `json:"cacheDir,omitempty" yaml:"cacheDir,omitempty"`
+
+	// KeepTmpOnError, if true, keeps {tmpDir} when generating fails,
+	// logging where it is, so the values files and whatever helm left
+	// there can be inspected.  Successful builds still remove it.
+	KeepTmpOnError bool `json:"keepTmpOnError,omitempty" yaml:"keepTmpOnError,omitempty"`
+
+	// RenderCacheDir, if set, is a directory in which to keep the output
+	// of helm template, named after a hash of everything that goes into
+	// it: the chart's config, its values files, the helm version and the
+	// chart's files.  A build whose hash is already there skips running
+	// helm template, which helps with large umbrella charts.  Warnings
+	// helm printed aren't cached, so aren't recorded on a cache hit.
+	RenderCacheDir string `json:"renderCacheDir,omitempty" yaml:"renderCacheDir,omitempty"`
 }
 
 type HelmChart struct {
@@ -44,8 +70,67 @@ type HelmChart struct {
 	// Repo is a URL locating the chart on the internet.
 	// This is the argument to helm's  `--repo` flag, e.g.
 	// `https://itzg.github.io/minecraft-server-charts`.
+	// Besides http(s) and oci URLs, s3:// and gs:// URLs are supported
+	// if the helm-s3 or helm-gcs downloader plugin is installed.
 	Repo string `json:"repo,omitempty" yaml:"repo,omitempty"`
 
+	// PluginsDir is a local directory of helm plugins, e.g. downloaders
+	// for s3:// or gs:// repos, each in a subdirectory with its
+	// plugin.yaml.  They're linked into {ConfigHome}/.data/plugins, and
+	// helm is made to look for plugins there, rather than where the user
+	// installed theirs.
+	PluginsDir string `json:"pluginsDir,omitempty" yaml:"pluginsDir,omitempty"`
+
+	// HelmCommand is the helm binary to use for this chart when
+	// kustomize wasn't given one, e.g. by the --helm-command flag.
+	HelmCommand string `json:"helmCommand,omitempty" yaml:"helmCommand,omitempty"`
+
+	// HelmVersionRegex replaces the regular expression used to find the
+	// version in the output of 'helm version', e.g. for helm builds that
+	// print it unusually.  The version is what the expression matches or,
+	// if it has one, its subexpression named 'version', as in
+	// `myhelm (?P<version>\d+\.\d+\.\d+)`.
+	HelmVersionRegex string `json:"helmVersionRegex,omitempty" yaml:"helmVersionRegex,omitempty"`
+
+	// PullRetries is the number of times to retry a failed chart pull.
+	// A pull that the registry rate limited waits as long as the
+	// registry's Retry-After hint asks before being retried.
+	// Defaults to 0, i.e. no retries.
+	PullRetries int `json:"pullRetries,omitempty" yaml:"pullRetries,omitempty"`
+
+	// PullTTL, e.g. '1h', is how long a pulled chart is trusted.  A chart
+	// in ChartHome whose directory was last modified longer ago than that
+	// is removed and pulled again, so that a long-running process keeps up
+	// with a version that floats, e.g. a tag that is pushed to repeatedly.
+	// Defaults to never re-pulling.  Not applied with KeepTarball.
+	PullTTL string `json:"pullTTL,omitempty" yaml:"pullTTL,omitempty"` //nolint: tagliatelle
+
+	// CredentialsSecret is the path to a Secret whose base64-encoded
+	// data.username and data.password are used to authenticate to Repo,
+	// the way credentials are kept in a cluster.  They're handed to helm
+	// in config files it reads, never on its command line.
+	CredentialsSecret string `json:"credentialsSecret,omitempty" yaml:"credentialsSecret,omitempty"`
+
+	// Headers are HTTP headers the repo requires, e.g. of a gateway that
+	// authenticates by header.  Helm can't send arbitrary headers, so the
+	// only one supported is Authorization: a 'Basic' one is turned into
+	// the username and password helm pulls with, and a 'Bearer' one, for
+	// an oci repo only, into a token in the registry config helm uses.
+	// Nor can helm be made to send any User-Agent but its own.
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+
+	// KeyringURL locates a public keyring, e.g.
+	// https://example.com/charts/pubring.gpg, to verify the chart's
+	// signature with when pulling it, by passing helm the --verify flag.
+	// The keyring is downloaded to a temporary directory before the pull.
+	KeyringURL string `json:"keyringURL,omitempty" yaml:"keyringURL,omitempty"` //nolint: tagliatelle
+
+	// TLSCABundle is a local file path to a bundle of PEM encoded CA
+	// certificates that helm should trust, e.g. those of a TLS
+	// intercepting proxy.  It is passed to helm via the SSL_CERT_FILE
+	// environment variable.
+	TLSCABundle string `json:"tlsCABundle,omitempty" yaml:"tlsCABundle,omitempty"` //nolint: tagliatelle
+
 	// ReleaseName replaces RELEASE-NAME in chart template output,
 	// making a particular inflation of a chart unique with respect to
 	// other inflations of the same chart in a cluster. It's the first
@@ -55,36 +140,307 @@ type HelmChart struct {
 	// If omitted, the flag --generate-name is passed to 'helm template'.
 	ReleaseName string `json:"releaseName,omitempty" yaml:"releaseName,omitempty"`
 
+	// ReleaseNameTemplate, if set instead of ReleaseName, is a Go template
+	// rendered at build time into the release name, e.g.
+	// '{{ .Env.ENV }}-{{ .Data.app }}', where .Env holds the environment
+	// variables kustomize runs with, and .Data holds ReleaseNameData.
+	// Unlike NameTemplate, it's rendered by kustomize, not helm, so it
+	// knows nothing of the chart.
+	ReleaseNameTemplate string `json:"releaseNameTemplate,omitempty" yaml:"releaseNameTemplate,omitempty"`
+
+	// ReleaseNameData is given to ReleaseNameTemplate as .Data.
+	ReleaseNameData map[string]string `json:"releaseNameData,omitempty" yaml:"releaseNameData,omitempty"`
+
+	// ReleaseRevision is meant to be .Release.Revision in the helm template.
+	// 'helm template' always renders revision 1 and has no flag to change
+	// that, so kustomize passes the revision to the chart as the value
+	// 'releaseRevision' instead.  The chart is still rendered as an
+	// install, whatever the revision.
+	ReleaseRevision int `json:"releaseRevision,omitempty" yaml:"releaseRevision,omitempty"`
+
+	// ReleaseService is meant to be .Release.Service in the helm template,
+	// which 'helm template' always renders as 'Helm'.  Having no flag to
+	// change that, kustomize renders a copy of the chart in which
+	// .Release.Service is replaced by this string in the templates of
+	// the chart and of its unpacked subcharts.
+	ReleaseService string `json:"releaseService,omitempty" yaml:"releaseService,omitempty"`
+
+	// ChartNameOverride is meant to be .Chart.Name in the helm template.
+	// Kustomize renders a copy of the chart whose Chart.yaml has this
+	// name, so that the names the chart derives from its own change too.
+	ChartNameOverride string `json:"chartNameOverride,omitempty" yaml:"chartNameOverride,omitempty"`
+
 	// Namespace set the target namespace for a release. It is .Release.Namespace
 	// in the helm template
 	Namespace string `json:"namespace,omitempty" yaml:"namespace,omitempty"`
 
+	// TargetNamespace, if set, is the namespace every namespaced resource
+	// generated from the chart is placed in, regardless of Namespace.
+	// Namespace remains what the chart sees as .Release.Namespace, e.g.
+	// for the namespace in the URLs of services it references.
+	TargetNamespace string `json:"targetNamespace,omitempty" yaml:"targetNamespace,omitempty"`
+
+	// RequireNamespace, if true and Namespace isn't set, makes it an error
+	// for any namespaced resource generated from the chart to lack a
+	// namespace, rather than rely on the namespace it's applied to.
+	RequireNamespace bool `json:"requireNamespace,omitempty" yaml:"requireNamespace,omitempty"`
+
+	// CreateNamespace, if true, adds a Namespace resource for
+	// TargetNamespace, or Namespace if that's not set, to the output,
+	// unless the chart already produces one, like
+	// 'helm install --create-namespace'.
+	CreateNamespace bool `json:"createNamespace,omitempty" yaml:"createNamespace,omitempty"`
+
 	// AdditionalValuesFiles are local file paths to values files to be used in
 	// addition to either the default values file or the values specified in ValuesFile.
-	AdditionalValuesFiles []string `json:"additionalValuesFiles,omitempty" yaml:"additionalValuesFiles,omitempty"`
+	// Entries may also be {path, priority} objects; see HelmValuesFiles.
+	AdditionalValuesFiles HelmValuesFiles `json:"additionalValuesFiles,omitempty" yaml:"additionalValuesFiles,omitempty"`
+
+	// ChartFromResource locates a chart archive embedded in a ConfigMap,
+	// to use instead of pulling the chart or finding it in ChartHome.
+	ChartFromResource *HelmChartResource `json:"chartFromResource,omitempty" yaml:"chartFromResource,omitempty"`
+
+	// KeepTarball, if true, makes the chart be pulled into ChartHome as
+	// the archive helm pull downloads, '{Name}-{Version}.tgz', instead of
+	// being unpacked, and templated from that archive, e.g. to record the
+	// digest of the exact artifact.  The chart's default values file isn't
+	// read from the archive; helm applies those defaults itself.
+	KeepTarball bool `json:"keepTarball,omitempty" yaml:"keepTarball,omitempty"`
+
+	// RequireChartApiVersion, if set, makes it an error for the apiVersion
+	// in the chart's Chart.yaml to differ, e.g. 'v2' catches a chart made
+	// for helm 2, whose charts have apiVersion 'v1'.
+	RequireChartApiVersion string `json:"requireChartApiVersion,omitempty" yaml:"requireChartApiVersion,omitempty"`
+
+	// RequireAppVersion, if set, makes it an error for the appVersion in
+	// the chart's Chart.yaml to differ, e.g. to catch a bump of the chart's
+	// version that didn't bring the version of the app a release expects.
+	RequireAppVersion string `json:"requireAppVersion,omitempty" yaml:"requireAppVersion,omitempty"`
+
+	// WarnIfOutdated, if true, makes the generator ask Repo for the latest
+	// version of the chart, and log a warning if it's newer than Version,
+	// nudging towards an update without forcing one.  It costs a request
+	// to the repo on every build, and a failed request is only logged.
+	WarnIfOutdated bool `json:"warnIfOutdated,omitempty" yaml:"warnIfOutdated,omitempty"`
+
+	// Environment, if set, makes kustomize look for a values file named
+	// 'values-{Environment}.yaml' in the chart directory, and use it in
+	// addition to the other values files if it exists.  It takes effect
+	// before AdditionalValuesFiles, so those may still override it.
+	// The file is silently skipped if absent.
+	Environment string `json:"environment,omitempty" yaml:"environment,omitempty"`
 
 	// ValuesFile is a local file path to a values file to use _instead of_
 	// the default values that accompanied the chart.
 	// The default values are in '{ChartHome}/{Name}/values.yaml'.
 	ValuesFile string `json:"valuesFile,omitempty" yaml:"valuesFile,omitempty"`
 
+	// DefaultValuesFileName replaces 'values.yaml' as the name of the
+	// default values file in the chart directory, e.g. 'values.base.yaml'.
+	DefaultValuesFileName string `json:"defaultValuesFileName,omitempty" yaml:"defaultValuesFileName,omitempty"`
+
 	// ValuesInline holds value mappings specified directly,
 	// rather than in a separate file.
 	ValuesInline map[string]interface{} `json:"valuesInline,omitempty" yaml:"valuesInline,omitempty"`
 
+	// ValuesOverlays are values merged into ValuesInline, each at its own
+	// location, e.g. only under subchartA.component.  Their values take
+	// precedence over ValuesInline, and later overlays over earlier ones.
+	ValuesOverlays []HelmValuesOverlay `json:"valuesOverlays,omitempty" yaml:"valuesOverlays,omitempty"`
+
+	// ConditionsFile is a local file path to a flat map of values paths to
+	// booleans, e.g. 'subchartA.enabled: true', typically enabling or
+	// disabling subcharts.  The toggles are merged into ValuesInline
+	// like ValuesOverlays, but ahead of them.
+	ConditionsFile string `json:"conditionsFile,omitempty" yaml:"conditionsFile,omitempty"`
+
+	// SubchartValuesFiles maps the names of subcharts to local file paths
+	// of values files for them, written as if for the subchart on its own,
+	// e.g. 'postgresql: values-db.yaml'.  Each file's values are nested
+	// under the subchart's key and merged into ValuesInline like
+	// ValuesOverlays, but ahead of them and of ConditionsFile.
+	SubchartValuesFiles map[string]string `json:"subchartValuesFiles,omitempty" yaml:"subchartValuesFiles,omitempty"`
+
+	// ValuesFromConfigMaps take values from ConfigMaps in the build, e.g.
+	// made by a configMapGenerator of the same kustomization, so values
+	// produced earlier in the build flow into the chart.  Their values are
+	// merged into ValuesInline like ValuesOverlays, but ahead of them, of
+	// ConditionsFile and of SubchartValuesFiles, and later ConfigMaps
+	// take precedence over earlier ones.
+	ValuesFromConfigMaps []HelmConfigMapValues `json:"valuesFromConfigMaps,omitempty" yaml:"valuesFromConfigMaps,omitempty"`
+
+	// VarReferences maps values paths, e.g. 'image.tag', to the names of
+	// vars declared in the build, whose values are set at those paths
+	// after ValuesOverlays.  A var is resolved against the resources of
+	// the build as they are when the chart is generated, i.e. before the
+	// kustomization's transformers run.  A var that can't be resolved is
+	// an error.
+	VarReferences map[string]string `json:"varReferences,omitempty" yaml:"varReferences,omitempty"`
+
 	// ValuesMerge specifies how to treat ValuesInline with respect to Values.
 	// Legal values: 'merge', 'override', 'replace'.
 	// Defaults to 'override'.
 	ValuesMerge string `json:"valuesMerge,omitempty" yaml:"valuesMerge,omitempty"`
 
+	// MergeBaseFile is a local file path to a values file for ValuesInline,
+	// along with ValuesOverlays, to be merged onto per ValuesMerge, e.g. an
+	// environment specific file, rather than ValuesFile.  ValuesFile is
+	// then given to helm as is, followed by the merged values.  It has no
+	// effect without inline values, and can't be combined with
+	// ValuesMerge 'replace'.
+	MergeBaseFile string `json:"mergeBaseFile,omitempty" yaml:"mergeBaseFile,omitempty"`
+
+	// InlineAlwaysWins makes ValuesInline, along with ValuesOverlays, take
+	// precedence over AdditionalValuesFiles too, not just over ValuesFile.
+	// The inline values are then given to helm in ValuesFile, which is
+	// passed after AdditionalValuesFiles, and what was in ValuesFile ahead
+	// of them.  It can't be combined with ValuesMerge 'merge'.
+	InlineAlwaysWins bool `json:"inlineAlwaysWins,omitempty" yaml:"inlineAlwaysWins,omitempty"`
+
+	// Deprecations are values paths, e.g. 'ingress.className', that the
+	// chart deprecates, in addition to those listed by the chart's own
+	// values.deprecations.yaml, if it has one.  ValuesInline, along with
+	// ValuesOverlays, setting any of them is reported per DeprecationPolicy.
+	Deprecations []string `json:"deprecations,omitempty" yaml:"deprecations,omitempty"`
+
+	// DeprecationPolicy specifies what to do about deprecated values
+	// being set.  Legal values: 'warn', to log a warning; 'error', to fail.
+	// Defaults to 'warn'.
+	DeprecationPolicy string `json:"deprecationPolicy,omitempty" yaml:"deprecationPolicy,omitempty"`
+
+	// OnMissingValues specifies what to do if ValuesFile, by default
+	// the chart's values.yaml, doesn't exist.
+	// Legal values: 'error', to fail; 'ignore', to give helm no values
+	// file; 'empty', to give helm an empty values file.
+	// Defaults to 'error'.
+	OnMissingValues string `json:"onMissingValues,omitempty" yaml:"onMissingValues,omitempty"`
+
+	// DecryptCommand is an executable, e.g. a wrapper around sops, that
+	// ValuesFile is piped through before use, for values files kept
+	// encrypted.  It reads the encrypted values on stdin and writes the
+	// decrypted values to stdout.  It's killed if it runs longer than
+	// DecryptTimeout.
+	DecryptCommand string `json:"decryptCommand,omitempty" yaml:"decryptCommand,omitempty"`
+
+	// DecryptTimeout is how long DecryptCommand may run, e.g. '30s'.
+	// Defaults to a minute.
+	DecryptTimeout string `json:"decryptTimeout,omitempty" yaml:"decryptTimeout,omitempty"`
+
 	// IncludeCRDs specifies if Helm should also generate CustomResourceDefinitions.
 	// Defaults to 'false'.
+	// The generator passes helm template either --include-crds or, rather
+	// than rely on helm's default, which has changed across versions,
+	// --skip-crds.  Either way, CRDs in the chart's templates are rendered.
 	IncludeCRDs bool `json:"includeCRDs,omitempty" yaml:"includeCRDs,omitempty"` //nolint: tagliatelle
 
+	// SkipCRDs removes all CustomResourceDefinitions from the output,
+	// including those rendered from the chart's templates, e.g. for
+	// clusters where CRDs are managed separately.
+	// It cannot be combined with IncludeCRDs.
+	// Defaults to 'false'.
+	SkipCRDs bool `json:"skipCRDs,omitempty" yaml:"skipCRDs,omitempty"` //nolint: tagliatelle
+
+	// ExcludeByLabels removes from the output every resource having all
+	// of these labels, e.g. {app.kubernetes.io/component: test}.
+	ExcludeByLabels map[string]string `json:"excludeByLabels,omitempty" yaml:"excludeByLabels,omitempty"`
+
+	// ExcludeResources removes from the output the resources they name,
+	// e.g. a default ServiceAccount managed elsewhere, matched by kind,
+	// name and, if given, namespace as the chart renders them.
+	ExcludeResources []HelmResourceRef `json:"excludeResources,omitempty" yaml:"excludeResources,omitempty"`
+
+	// WarnOnUnmatchedExcludes, if true, logs a warning for each of
+	// ExcludeResources that matches no resource, e.g. because the
+	// chart has renamed it.
+	WarnOnUnmatchedExcludes bool `json:"warnOnUnmatchedExcludes,omitempty" yaml:"warnOnUnmatchedExcludes,omitempty"`
+
 	// SkipHooks sets the --no-hooks flag when calling helm template. This prevents
 	// helm from erroneously rendering test templates.
+	// Helm then leaves out every hook, i.e. every resource annotated
+	// with helm.sh/hook, not only tests.
 	SkipHooks bool `json:"skipHooks,omitempty" yaml:"skipHooks,omitempty"`
 
+	// DropHooksWithDeletePolicy removes from the output the hooks whose
+	// helm.sh/hook-delete-policy annotation has any of these policies,
+	// e.g. [hook-succeeded] to leave out the hooks helm deletes once they
+	// have run, which would otherwise show up as churn in GitOps tools.
+	// Each must be one of before-hook-creation, hook-succeeded and
+	// hook-failed.  It cannot be combined with SkipHooks.
+	DropHooksWithDeletePolicy []string `json:"dropHooksWithDeletePolicy,omitempty" yaml:"dropHooksWithDeletePolicy,omitempty"`
+
+	// SetJSONValues are passed to helm template as --set-json flags,
+	// mapping a values path to JSON, e.g. to set a whole list in one line.
+	// They require helm v3.10.0 or later.
+	SetJSONValues map[string]string `json:"setJSONValues,omitempty" yaml:"setJSONValues,omitempty"` //nolint: tagliatelle
+
+	// SetArgs is passed to helm template as a --set flag, as copied
+	// from a helm command line, e.g. 'image.tag=1.2.3,args[0]=--verbose'.
+	SetArgs string `json:"setArgs,omitempty" yaml:"setArgs,omitempty"`
+
+	// OnlySubchart, if set, renders only the templates of the named
+	// subchart of an umbrella chart, by passing helm template
+	// '--show-only charts/{OnlySubchart}/templates/*'.  Helm matches the
+	// pattern against template paths, so templates in subdirectories of
+	// the subchart's templates directory, and those of its own subcharts,
+	// are left out.
+	OnlySubchart string `json:"onlySubchart,omitempty" yaml:"onlySubchart,omitempty"`
+
+	// DependencyUpdate, if true, makes helm fetch the chart's dependencies
+	// into its charts directory before templating it.  If the chart has a
+	// lock file, Chart.lock, the versions it pins are fetched, with
+	// 'helm dependency build', so the dependencies don't drift; otherwise
+	// the latest versions Chart.yaml allows are, with
+	// 'helm dependency update'.
+	DependencyUpdate bool `json:"dependencyUpdate,omitempty" yaml:"dependencyUpdate,omitempty"`
+
+	// ForceDependencyUpdate makes DependencyUpdate run
+	// 'helm dependency update' even if the chart has a lock file,
+	// updating the lock file along with the dependencies.
+	ForceDependencyUpdate bool `json:"forceDependencyUpdate,omitempty" yaml:"forceDependencyUpdate,omitempty"`
+
+	// WorkDir is the local directory helm template is run in, so that
+	// anything relative the chart leaves helm to resolve, like the
+	// repository of a dependency in Chart.yaml, is resolved the same
+	// whatever directory kustomize runs in.  It must exist.
+	// Defaults to the directory of the chart.
+	WorkDir string `json:"workDir,omitempty" yaml:"workDir,omitempty"`
+
+	// HelmOpTimeout is passed to helm template as --timeout, the time
+	// helm allows itself for an operation, e.g. '90s' or '5m'.  Of the
+	// helm commands kustomize runs, only template takes the flag, so it
+	// doesn't bound pulling the chart.
+	HelmOpTimeout string `json:"helmOpTimeout,omitempty" yaml:"helmOpTimeout,omitempty"`
+
+	// TemplateRetries is the number of times to retry helm template when
+	// what it printed to stderr matches one of TemplateRetryPatterns, e.g.
+	// when a lookup function couldn't reach the API server.  Any other
+	// failure to render is taken to be deterministic, and never retried.
+	// Defaults to 0, i.e. no retries.
+	TemplateRetries int `json:"templateRetries,omitempty" yaml:"templateRetries,omitempty"`
+
+	// TemplateRetryPatterns are the regular expressions matching the
+	// transient failures TemplateRetries retries.
+	// Defaults to [connection refused, connection reset by peer,
+	// i/o timeout, TLS handshake timeout].
+	TemplateRetryPatterns []string `json:"templateRetryPatterns,omitempty" yaml:"templateRetryPatterns,omitempty"`
+
+	// RenderSubchartNotes sets the --render-subchart-notes flag when
+	// calling helm template, so that the NOTES.txt of subcharts are
+	// rendered along with the chart's own.  Helm template doesn't print
+	// notes, so the flag only matters to something capturing them.
+	RenderSubchartNotes bool `json:"renderSubchartNotes,omitempty" yaml:"renderSubchartNotes,omitempty"`
+
+	// HelmLabels are passed to helm template as --labels flags, which
+	// helm records as labels of the release.  They require helm v3.13.0
+	// or later.
+	HelmLabels map[string]string `json:"helmLabels,omitempty" yaml:"helmLabels,omitempty"`
+
+	// SkipSchemaValidation sets the --skip-schema-validation flag when
+	// calling helm template, so that values may be given in ways the
+	// chart's values.schema.json forbids.  It requires helm v3.16.0
+	// or later.
+	SkipSchemaValidation bool `json:"skipSchemaValidation,omitempty" yaml:"skipSchemaValidation,omitempty"`
+
 	// ApiVersions is the kubernetes apiversions used for Capabilities.APIVersions
 	ApiVersions []string `json:"apiVersions,omitempty" yaml:"apiVersions,omitempty"`
 
@@ -97,8 +453,263 @@ type HelmChart struct {
 	// SkipTests skips tests from templated output.
 	SkipTests bool `json:"skipTests,omitempty" yaml:"skipTests,omitempty"`
 
+	// AddConfigHashAnnotation, if true, annotates every generated resource
+	// with kustomize.helm/config-hash, a hash of the effective generator
+	// config (chart, version, values and flags).  Downstream tools can
+	// use it to notice when the inputs of a generation changed.
+	AddConfigHashAnnotation bool `json:"addConfigHashAnnotation,omitempty" yaml:"addConfigHashAnnotation,omitempty"`
+
+	// ChartAlias, if set, annotates every generated resource with
+	// kustomize.helm/chart-alias set to it, e.g. 'monitoring', so that
+	// in the output of several charts one can tell which chart produced
+	// which resource, without renaming anything.
+	ChartAlias string `json:"chartAlias,omitempty" yaml:"chartAlias,omitempty"`
+
+	// ExplicitDocumentStart, if true, starts every document of the
+	// stream RenderCanonical returns with '---', the first one included,
+	// for tools that expect every document to be marked that way.
+	ExplicitDocumentStart bool `json:"explicitDocumentStart,omitempty" yaml:"explicitDocumentStart,omitempty"`
+
+	// RecordWarningsAnnotation, if true, keeps the warnings helm prints
+	// while rendering the chart, by annotating the first generated
+	// resource with kustomize.helm/warnings, one warning per line.
+	RecordWarningsAnnotation bool `json:"recordWarningsAnnotation,omitempty" yaml:"recordWarningsAnnotation,omitempty"`
+
+	// NamePrefix and NameSuffix are added to the metadata.name of every
+	// resource generated from the chart.  Unlike the namePrefix and
+	// nameSuffix fields of a kustomization, they don't update references
+	// to the renamed resources, e.g. a Deployment's reference to a ConfigMap.
+	NamePrefix string `json:"namePrefix,omitempty" yaml:"namePrefix,omitempty"`
+	NameSuffix string `json:"nameSuffix,omitempty" yaml:"nameSuffix,omitempty"`
+
+	// OverlayChart is the name of a chart in ChartHome rendered with the
+	// same release and values as the main chart.  Each resource it produces
+	// is merged into the main chart's resource with the same id, or added
+	// if there's none, so the chart can be patched without forking it.
+	OverlayChart string `json:"overlayChart,omitempty" yaml:"overlayChart,omitempty"`
+
+	// RemoveFields are the paths of fields to delete from every generated
+	// resource that has them, e.g. 'status' or, bracketing a key that has
+	// dots, 'metadata.annotations.[helm.sh/resource-policy]'.  Paths
+	// use the field path syntax of replacements, so may pick list entries
+	// like '[name=app]' along the way, but must end in a field name.
+	RemoveFields []string `json:"removeFields,omitempty" yaml:"removeFields,omitempty"`
+
+	// ExtraResources are added to the resources generated from the chart,
+	// e.g. a NetworkPolicy for the release.  Each entry is either a local
+	// file path or, if it spans several lines, YAML documents given inline.
+	// An extra resource with the same id as a chart resource is handled
+	// per ExtraResourcesCollision.
+	ExtraResources []string `json:"extraResources,omitempty" yaml:"extraResources,omitempty"`
+
+	// ExtraResourcesCollision specifies what to do with an extra resource
+	// that has the same id as a chart resource.
+	// Legal values: 'error', to fail; 'extra-wins', to replace the chart
+	// resource with it; 'chart-wins', to drop it; 'merge', to apply it to
+	// the chart resource as a strategic merge patch, making ExtraResources
+	// a lightweight way to patch the chart.
+	// Defaults to 'error'.
+	ExtraResourcesCollision string `json:"extraResourcesCollision,omitempty" yaml:"extraResourcesCollision,omitempty"`
+
+	// AllowedImageRegistries, if not empty, makes it an error for any
+	// container of the generated resources to use an image from another
+	// registry, e.g. [registry.example.com, docker.io].  Images without a
+	// registry, such as 'nginx:1.25', come from docker.io.
+	AllowedImageRegistries []string `json:"allowedImageRegistries,omitempty" yaml:"allowedImageRegistries,omitempty"`
+
+	// ImageDenylist, if not empty, makes it an error for any container of
+	// the generated resources to use an image matching one of its glob
+	// patterns, e.g. 'nginx:1.19.*' or 'registry.example.com/*:debug'.
+	// Images and patterns are compared in full, so 'nginx' is taken to
+	// be 'docker.io/library/nginx:latest'.
+	ImageDenylist []string `json:"imageDenylist,omitempty" yaml:"imageDenylist,omitempty"`
+
+	// RequireImageDigests, if true, makes it an error for any container of
+	// the generated resources to use an image by tag rather than by digest,
+	// e.g. 'nginx:1.25' rather than 'nginx@sha256:...', so that the images
+	// deployed can't change under the same name.  An image with neither,
+	// such as 'nginx', is taken to be using the latest tag.
+	RequireImageDigests bool `json:"requireImageDigests,omitempty" yaml:"requireImageDigests,omitempty"`
+
+	// ForbidInlineSecrets, if true, makes it an error for ValuesInline
+	// or ValuesOverlays to give a non-empty string to a key matching one
+	// of SecretKeyPatterns, so that secrets are kept out of kustomizations
+	// and given to the chart some other way.
+	ForbidInlineSecrets bool `json:"forbidInlineSecrets,omitempty" yaml:"forbidInlineSecrets,omitempty"`
+
+	// SecretKeyPatterns are the regular expressions ForbidInlineSecrets
+	// looks for in the keys of values, ignoring case.
+	// Defaults to [password, token, apiKey].
+	SecretKeyPatterns []string `json:"secretKeyPatterns,omitempty" yaml:"secretKeyPatterns,omitempty"`
+
+	// KindPriority, if not empty, sorts the generated resources by the
+	// priority of their kind, lowest first, and then by name, e.g.
+	// {Namespace: 0, CustomResourceDefinition: 1} to have those kinds
+	// installed first.  Kinds that aren't listed have priority 50.
+	KindPriority map[string]int `json:"kindPriority,omitempty" yaml:"kindPriority,omitempty"`
+
+	// OrderHooksByWeight, if true, puts pre-install and pre-upgrade hooks
+	// before the other resources, and post-install and post-upgrade hooks
+	// after them, each ordered by their helm.sh/hook-weight annotation.
+	// Other hooks, e.g. tests, come last.
+	OrderHooksByWeight bool `json:"orderHooksByWeight,omitempty" yaml:"orderHooksByWeight,omitempty"`
+
+	// StrictParse, if true, makes any failure to parse the output of helm
+	// an error, rather than retrying without whatever helm may have
+	// printed ahead of the first document.  It suits a chart known to
+	// print nothing but YAML, so that the retry, which a chart starting
+	// its output with '---' can trip up, never replaces the original
+	// parse error with its own.
+	// Defaults to 'false'.
+	StrictParse bool `json:"strictParse,omitempty" yaml:"strictParse,omitempty"`
+
+	// DiffAgainst is a local file path to manifests previously generated
+	// from this chart.  It's used by GenerateAndDiff, which reports the
+	// resources added, removed and changed by a fresh rendering.
+	DiffAgainst string `json:"diffAgainst,omitempty" yaml:"diffAgainst,omitempty"`
+
+	// CompareKubeVersions lists two kubernetes versions, e.g.
+	// [1.21.0, 1.25.0], for DiffKubeVersions to render the chart against
+	// in place of KubeVersion, reporting the resources that render
+	// differently, e.g. because the chart picks their apiVersion by the
+	// version of kubernetes.
+	CompareKubeVersions []string `json:"compareKubeVersions,omitempty" yaml:"compareKubeVersions,omitempty"`
+
+	// EmitKustomization, if true, makes RenderToDir also write a
+	// kustomization.yaml listing the files it writes as resources, so
+	// that the directory can be used as a kustomize base.
+	EmitKustomization bool `json:"emitKustomization,omitempty" yaml:"emitKustomization,omitempty"`
+
 	// debug enables debug output from the Helm chart inflator generator.
 	Debug bool `json:"debug,omitempty" yaml:"debug,omitempty"`
+
+	// MaxErrorBytes, if positive, limits how much of what helm printed
+	// goes into the error of a helm command that failed: the first and
+	// last halves of that many bytes are kept, around a '[truncated]'
+	// marker, so that a chart failing loudly leaves a readable error.
+	// Defaults to 0, i.e. no limit.
+	MaxErrorBytes int `json:"maxErrorBytes,omitempty" yaml:"maxErrorBytes,omitempty"`
+
+	// CaptureTiming, if true along with Debug, makes the generator time
+	// each phase of the generation, including helm's rendering, since
+	// helm's debug output doesn't include timings.
+	CaptureTiming bool `json:"captureTiming,omitempty" yaml:"captureTiming,omitempty"`
+
+	// ExplainValues, if true, makes the generator work out which source
+	// each values path helm is given takes its final value from: the
+	// chart's defaults, ValuesFile, ValuesInline, one of ValuesOverlays,
+	// one of AdditionalValuesFiles, or SetJSONValues.  SetArgs aren't
+	// accounted for.
+	ExplainValues bool `json:"explainValues,omitempty" yaml:"explainValues,omitempty"`
+
+	// ReportOutput, if true, makes the generator count the resources it
+	// produces by kind, and hash them, so tools embedding it can tell
+	// what a chart deploys, and whether that's changed, without diffing.
+	// Hashing the output costs about as much as writing it out.
+	ReportOutput bool `json:"reportOutput,omitempty" yaml:"reportOutput,omitempty"`
+}
+
+// HelmPhaseTiming is how long a phase of generating resources
+// from a helm chart took.
+type HelmPhaseTiming struct {
+	Phase    string        `json:"phase" yaml:"phase"`
+	Duration time.Duration `json:"duration" yaml:"duration"`
+}
+
+// HelmValueSource names the source a values path
+// takes its final value from.
+type HelmValueSource struct {
+	Path   string `json:"path" yaml:"path"`
+	Source string `json:"source" yaml:"source"`
+}
+
+// HelmChartResource locates a chart archive (a .tgz file, base64
+// encoded) held by a ConfigMap, e.g. for air-gapped environments
+// where neither pulling charts nor committing binaries is an option.
+type HelmChartResource struct {
+	// Path is a local file path to the ConfigMap's YAML.
+	Path string `json:"path,omitempty" yaml:"path,omitempty"`
+
+	// Key is the key of the chart archive in the ConfigMap's
+	// binaryData or, failing that, data.
+	Key string `json:"key,omitempty" yaml:"key,omitempty"`
+}
+
+// HelmResourceRef names a resource rendered from a chart.
+type HelmResourceRef struct {
+	Kind string `json:"kind,omitempty" yaml:"kind,omitempty"`
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+
+	// Namespace, if empty, matches any namespace.
+	Namespace string `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+}
+
+// HelmConfigMapValues locates values in a ConfigMap in the build.
+type HelmConfigMapValues struct {
+	// Name is the name of the ConfigMap as it's generated or listed
+	// in resources, i.e. without any hash suffix or name prefix.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+
+	// Key, if set, is the key of the ConfigMap's data holding a values
+	// document, e.g. 'values.yaml'.  Otherwise, each key of the data
+	// is a top level value, set to the key's string.
+	Key string `json:"key,omitempty" yaml:"key,omitempty"`
+}
+
+// HelmValuesOverlay holds values to merge at a given location in a
+// chart's values.
+type HelmValuesOverlay struct {
+	// Path is the dotted path of the map to merge Values into,
+	// e.g. 'subchartA.component'.
+	Path string `json:"path,omitempty" yaml:"path,omitempty"`
+
+	// Values are the values to merge.
+	Values map[string]interface{} `json:"values,omitempty" yaml:"values,omitempty"`
+}
+
+// HelmValuesFiles is a list of values file paths, in the order they
+// are passed to helm, so that later files override earlier ones.
+//
+// When decoded, each entry may be either a path or a {path, priority}
+// object, e.g. {path: prod.yaml, priority: 10}, and the list is sorted
+// by ascending priority, so the file with the highest priority wins
+// regardless of where it is listed.  Entries without a priority have
+// priority 0, and entries with equal priorities keep their list order.
+type HelmValuesFiles []string
+
+// helmValuesFile is an entry of HelmValuesFiles given as an object.
+type helmValuesFile struct {
+	Path     string `json:"path"`
+	Priority int    `json:"priority,omitempty"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (f *HelmValuesFiles) UnmarshalJSON(data []byte) error {
+	var entries []json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	files := make([]helmValuesFile, len(entries))
+	for i, entry := range entries {
+		if err := json.Unmarshal(entry, &files[i].Path); err == nil {
+			continue
+		}
+		if err := json.Unmarshal(entry, &files[i]); err != nil {
+			return fmt.Errorf(
+				"additionalValuesFiles entry must be a path or a {path, priority} object: %w", err)
+		}
+		if files[i].Path == "" {
+			return fmt.Errorf("additionalValuesFiles entry %d has no path", i)
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].Priority < files[j].Priority
+	})
+	*f = make(HelmValuesFiles, len(files))
+	for i := range files {
+		(*f)[i] = files[i].Path
+	}
+	return nil
 }
 
 // HelmChartArgs contains arguments to helm.
@@ -149,6 +760,16 @@ func makeHelmChartFromHca(old *HelmChartArgs) (c HelmChart) {
 }
 
 func (h HelmChart) AsHelmArgs(absChartHome string) []string {
+	var chartPath string
+	if h.Name != "" {
+		chartPath = filepath.Join(absChartHome, h.Name)
+	}
+	return h.AsHelmArgsForChart(chartPath)
+}
+
+// AsHelmArgsForChart is like AsHelmArgs, but takes the path of the chart
+// itself, which may be a chart archive rather than a directory.
+func (h HelmChart) AsHelmArgsForChart(chartPath string) []string {
 	args := []string{"template"}
 	if h.ReleaseName != "" {
 		args = append(args, h.ReleaseName)
@@ -158,8 +779,8 @@ func (h HelmChart) AsHelmArgs(absChartHome string) []string {
 		// I've tried placing the flag before and after the name argument.
 		args = append(args, "--generate-name")
 	}
-	if h.Name != "" {
-		args = append(args, filepath.Join(absChartHome, h.Name))
+	if chartPath != "" {
+		args = append(args, chartPath)
 	}
 	if h.Namespace != "" {
 		args = append(args, "--namespace", h.Namespace)
@@ -168,12 +789,29 @@ func (h HelmChart) AsHelmArgs(absChartHome string) []string {
 		args = append(args, "--name-template", h.NameTemplate)
 	}
 
-	if h.ValuesFile != "" {
+	if h.ValuesFile != "" && !h.InlineAlwaysWins {
 		args = append(args, "-f", h.ValuesFile)
 	}
 	for _, valuesFile := range h.AdditionalValuesFiles {
 		args = append(args, "-f", valuesFile)
 	}
+	if h.ValuesFile != "" && h.InlineAlwaysWins {
+		args = append(args, "-f", h.ValuesFile)
+	}
+	if h.ReleaseRevision > 0 {
+		args = append(args, "--set", fmt.Sprintf("releaseRevision=%d", h.ReleaseRevision))
+	}
+	jsonValues := make([]string, 0, len(h.SetJSONValues))
+	for k, v := range h.SetJSONValues {
+		jsonValues = append(jsonValues, k+"="+v)
+	}
+	sort.Strings(jsonValues)
+	for _, value := range jsonValues {
+		args = append(args, "--set-json", value)
+	}
+	if h.SetArgs != "" {
+		args = append(args, "--set", h.SetArgs)
+	}
 
 	for _, apiVer := range h.ApiVersions {
 		args = append(args, "--api-versions", apiVer)
@@ -182,8 +820,11 @@ func (h HelmChart) AsHelmArgs(absChartHome string) []string {
 		args = append(args, "--kube-version", h.KubeVersion)
 	}
 
+	// Explicit either way, since helm's default has changed across versions.
 	if h.IncludeCRDs {
 		args = append(args, "--include-crds")
+	} else {
+		args = append(args, "--skip-crds")
 	}
 	if h.SkipTests {
 		args = append(args, "--skip-tests")
@@ -191,6 +832,26 @@ func (h HelmChart) AsHelmArgs(absChartHome string) []string {
 	if h.SkipHooks {
 		args = append(args, "--no-hooks")
 	}
+	if h.OnlySubchart != "" {
+		args = append(args, "--show-only", "charts/"+h.OnlySubchart+"/templates/*")
+	}
+	labels := make([]string, 0, len(h.HelmLabels))
+	for k, v := range h.HelmLabels {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		args = append(args, "--labels", label)
+	}
+	if h.SkipSchemaValidation {
+		args = append(args, "--skip-schema-validation")
+	}
+	if h.HelmOpTimeout != "" {
+		args = append(args, "--timeout", h.HelmOpTimeout)
+	}
+	if h.RenderSubchartNotes {
+		args = append(args, "--render-subchart-notes")
+	}
 	if h.Debug {
 		args = append(args, "--debug")
 	}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/stretchr/testify/require"
 	"sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/yaml"
 )
 
 func TestAsHelmArgs(t *testing.T) {
@@ -58,7 +59,22 @@ func TestAsHelmArgs(t *testing.T) {
 				"--name-template", "template",
 				"-f", "values",
 				"-f", "values1", "-f", "values2",
-				"--api-versions", "foo", "--api-versions", "bar"})
+				"--api-versions", "foo", "--api-versions", "bar",
+				"--skip-crds"})
+	})
+
+	t.Run("use release-revision", func(t *testing.T) {
+		p := types.HelmChart{
+			Name:            "chart-name",
+			ReleaseName:     "test",
+			ValuesFile:      "values",
+			ReleaseRevision: 3,
+		}
+		require.Equal(t, p.AsHelmArgs("/home/charts"),
+			[]string{"template", "test", "/home/charts/chart-name",
+				"-f", "values",
+				"--set", "releaseRevision=3",
+				"--skip-crds"})
 	})
 
 	t.Run("use helm-debug", func(t *testing.T) {
@@ -75,6 +91,134 @@ func TestAsHelmArgs(t *testing.T) {
 				"-f", "values",
 				"-f", "values1",
 				"-f", "values2",
+				"--skip-crds",
 				"--debug"})
 	})
+	t.Run("use skip-schema-validation", func(t *testing.T) {
+		p := types.HelmChart{
+			Name:                 "chart-name",
+			ReleaseName:          "test",
+			SkipSchemaValidation: true,
+		}
+		require.Equal(t, p.AsHelmArgs("/home/charts"),
+			[]string{"template", "test", "/home/charts/chart-name",
+				"--skip-crds", "--skip-schema-validation"})
+	})
+
+	t.Run("use helm-labels", func(t *testing.T) {
+		p := types.HelmChart{
+			Name:        "chart-name",
+			ReleaseName: "test",
+			HelmLabels:  map[string]string{"team": "web", "env": "prod"},
+		}
+		require.Equal(t, p.AsHelmArgs("/home/charts"),
+			[]string{"template", "test", "/home/charts/chart-name",
+				"--skip-crds", "--labels", "env=prod", "--labels", "team=web"})
+	})
+
+	t.Run("use set-json values", func(t *testing.T) {
+		p := types.HelmChart{
+			Name:          "chart-name",
+			ReleaseName:   "test",
+			SetJSONValues: map[string]string{"tolerations": `[{"key":"gpu"}]`, "a.b": `1`},
+		}
+		require.Equal(t, p.AsHelmArgs("/home/charts"),
+			[]string{"template", "test", "/home/charts/chart-name",
+				"--set-json", "a.b=1", "--set-json", `tolerations=[{"key":"gpu"}]`,
+				"--skip-crds"})
+	})
+
+	t.Run("use only-subchart", func(t *testing.T) {
+		p := types.HelmChart{
+			Name:         "chart-name",
+			ReleaseName:  "test",
+			OnlySubchart: "postgresql",
+		}
+		require.Equal(t, p.AsHelmArgs("/home/charts"),
+			[]string{"template", "test", "/home/charts/chart-name",
+				"--skip-crds", "--show-only", "charts/postgresql/templates/*"})
+	})
+
+	t.Run("use helm-op-timeout", func(t *testing.T) {
+		p := types.HelmChart{
+			Name:          "chart-name",
+			ReleaseName:   "test",
+			HelmOpTimeout: "90s",
+		}
+		require.Equal(t, p.AsHelmArgs("/home/charts"),
+			[]string{"template", "test", "/home/charts/chart-name",
+				"--skip-crds", "--timeout", "90s"})
+	})
+
+	t.Run("use set-args", func(t *testing.T) {
+		p := types.HelmChart{
+			Name:          "chart-name",
+			ReleaseName:   "test",
+			SetJSONValues: map[string]string{"tolerations": "[]"},
+			SetArgs:       `a.b=1,c[0]=x,d\.e={f,g},h=`,
+		}
+		require.Equal(t, p.AsHelmArgs("/home/charts"),
+			[]string{"template", "test", "/home/charts/chart-name",
+				"--set-json", "tolerations=[]",
+				"--set", `a.b=1,c[0]=x,d\.e={f,g},h=`,
+				"--skip-crds"})
+	})
+
+	t.Run("use render-subchart-notes", func(t *testing.T) {
+		p := types.HelmChart{
+			Name:                "chart-name",
+			ReleaseName:         "test",
+			HelmOpTimeout:       "90s",
+			RenderSubchartNotes: true,
+		}
+		require.Equal(t, p.AsHelmArgs("/home/charts"),
+			[]string{"template", "test", "/home/charts/chart-name",
+				"--skip-crds", "--timeout", "90s", "--render-subchart-notes"})
+	})
+
+	t.Run("use inline-always-wins", func(t *testing.T) {
+		p := types.HelmChart{
+			Name:                  "chart-name",
+			ReleaseName:           "test",
+			ValuesFile:            "inline.yaml",
+			AdditionalValuesFiles: []string{"values.yaml", "prod.yaml"},
+			InlineAlwaysWins:      true,
+		}
+		require.Equal(t, p.AsHelmArgs("/home/charts"),
+			[]string{"template", "test", "/home/charts/chart-name",
+				"-f", "values.yaml",
+				"-f", "prod.yaml",
+				"-f", "inline.yaml",
+				"--skip-crds"})
+	})
+
+	t.Run("use values file priorities", func(t *testing.T) {
+		var p types.HelmChart
+		require.NoError(t, yaml.Unmarshal([]byte(`
+name: chart-name
+releaseName: test
+additionalValuesFiles:
+- path: prod.yaml
+  priority: 20
+- common.yaml
+- path: region.yaml
+  priority: 10
+- defaults.yaml
+`), &p))
+		require.Equal(t, p.AsHelmArgs("/home/charts"),
+			[]string{"template", "test", "/home/charts/chart-name",
+				"-f", "common.yaml",
+				"-f", "defaults.yaml",
+				"-f", "region.yaml",
+				"-f", "prod.yaml",
+				"--skip-crds"})
+	})
+
+	t.Run("use values file without path", func(t *testing.T) {
+		var p types.HelmChart
+		require.ErrorContains(t, yaml.Unmarshal([]byte(`
+additionalValuesFiles:
+- priority: 10
+`), &p), "additionalValuesFiles entry 0 has no path")
+	})
 }
@@ -4,15 +4,34 @@
 package main_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/kustomize/api/provider"
+	"sigs.k8s.io/kustomize/api/resmap"
 	kusttest_test "sigs.k8s.io/kustomize/api/testutils/kusttest"
+	"sigs.k8s.io/kustomize/api/types"
 	"sigs.k8s.io/kustomize/kyaml/copyutil"
+	"sigs.k8s.io/kustomize/kyaml/resid"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
 )
 
 func TestHelmChartInflationGenerator(t *testing.T) {
@@ -993,3 +1012,5235 @@ debug: true
 	assert.Contains(t, string(chartYamlContent), "name: test-chart")
 	assert.Contains(t, string(chartYamlContent), "version: 1.0.0")
 }
+
+func TestHelmChartInflationGeneratorGenerateByGroup(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	if err := th.ErrIfNoHelm(); err != nil {
+		t.Skip("skipping: " + err.Error())
+	}
+	copyTestChartsIntoHarness(t, th)
+
+	g := th.LoadGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: rbac-workload
+name: rbac-workload
+releaseName: app
+chartHome: ./charts
+`)
+	grouper, ok := g.(interface {
+		GenerateByGroup(map[string][]string) (map[string]resmap.ResMap, error)
+	})
+	require.True(t, ok)
+
+	groups, err := grouper.GenerateByGroup(map[string][]string{
+		"rbac":      {"ServiceAccount", "Role", "RoleBinding"},
+		"workloads": {"Deployment"},
+	})
+	require.NoError(t, err)
+	require.Len(t, groups, 3)
+
+	th.AssertActualEqualsExpected(groups["rbac"], `
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: app
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: app
+rules:
+- apiGroups:
+  - ""
+  resources:
+  - configmaps
+  verbs:
+  - get
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: app
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: app
+subjects:
+- kind: ServiceAccount
+  name: app
+`)
+	th.AssertActualEqualsExpected(groups["workloads"], `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+      - image: nginx:1.25
+        name: app
+      serviceAccountName: app
+`)
+	// Kinds not claimed by any group land in the default bucket.
+	th.AssertActualEqualsExpected(groups["default"], `
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+spec:
+  ports:
+  - port: 80
+`)
+}
+
+func TestHelmChartInflationGeneratorWithEnvironment(t *testing.T) {
+	tests := []struct {
+		name        string
+		environment string
+		expected    string
+	}{
+		{
+			name:        "environment values file present",
+			environment: "staging",
+			expected:    "staging",
+		},
+		{
+			name:        "environment values file absent",
+			environment: "prod",
+			expected:    "bar",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+				PrepBuiltin("HelmChartInflationGenerator")
+			defer th.Reset()
+			if err := th.ErrIfNoHelm(); err != nil {
+				t.Skip("skipping: " + err.Error())
+			}
+			copyTestChartsIntoHarness(t, th)
+
+			rm := th.LoadAndRunGenerator(fmt.Sprintf(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+environment: %s
+`, tt.environment))
+
+			cm, err := rm.Resources()[0].GetFieldValue("metadata.name")
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, cm)
+		})
+	}
+}
+
+func TestHelmChartInflationGeneratorWithEmbeddedDocumentSeparator(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	if err := th.ErrIfNoHelm(); err != nil {
+		t.Skip("skipping: " + err.Error())
+	}
+	copyTestChartsIntoHarness(t, th)
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: embedded-separator
+name: embedded-separator
+releaseName: test
+chartHome: ./charts
+`)
+
+	// The "---" inside the ConfigMap value must not split the document.
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+data:
+  manifests.yaml: |
+    apiVersion: v1
+    kind: Namespace
+    metadata:
+      name: first
+    ---
+    apiVersion: v1
+    kind: Namespace
+    metadata:
+      name: second
+kind: ConfigMap
+metadata:
+  name: test-manifests
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: test
+spec:
+  ports:
+  - port: 80
+`)
+}
+
+func TestHelmChartInflationGeneratorWithChartAlias(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: bar
+EOT
+`)
+	rm := th.LoadAndRunGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+chartAlias: monitoring
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  annotations:
+    kustomize.helm/chart-alias: monitoring
+  name: foo
+---
+apiVersion: v1
+kind: Service
+metadata:
+  annotations:
+    kustomize.helm/chart-alias: monitoring
+  name: bar
+`)
+}
+
+func TestHelmChartInflationGeneratorAdditionalValuesFilesEscape(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+	// Only the config is checked, so helm is never run.
+	writeFakeHelm(t, th, "exit 1\n")
+	th.MkDir("sub")
+	th.WriteF(filepath.Join(th.GetRoot(), "values.yaml"), "foo: baz\n")
+	base := filepath.Base(th.GetRoot())
+	// a values file beside the root, to escape to
+	outside, err := os.MkdirTemp(filepath.Dir(th.GetRoot()), "kust-outside-")
+	require.NoError(t, err)
+	defer os.RemoveAll(outside)
+	require.NoError(t, os.WriteFile(
+		filepath.Join(outside, "values.yaml"), []byte("foo: qux\n"), 0o600))
+	outside = filepath.Base(outside)
+
+	config := func(file string) string {
+		return fmt.Sprintf(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+additionalValuesFiles:
+- %s
+`, file)
+	}
+
+	for _, file := range []string{
+		"values.yaml",
+		"sub/../values.yaml",
+		"../" + base + "/values.yaml",
+		filepath.Join(th.GetRoot(), "values.yaml"),
+	} {
+		if err := th.ErrorFromLoadGenerator(config(file)); err != nil {
+			t.Errorf("%s: unexpected error: %v", file, err)
+		}
+	}
+	for _, file := range []string{
+		"../" + outside + "/values.yaml",
+		"sub/../../" + outside + "/values.yaml",
+		"sub/../../" + base + "/../" + outside + "/values.yaml",
+	} {
+		err := th.ErrorFromLoadGenerator(config(file))
+		require.ErrorContains(t, err, "could not load additionalValuesFile '"+file+"'")
+		require.ErrorContains(t, err, "is not in or below")
+	}
+}
+
+func TestHelmChartInflationGeneratorWithConfigHashAnnotation(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	if err := th.ErrIfNoHelm(); err != nil {
+		t.Skip("skipping: " + err.Error())
+	}
+	copyTestChartsIntoHarness(t, th)
+
+	configHash := func(version string, foo string) string {
+		t.Helper()
+		rm := th.LoadAndRunGenerator(fmt.Sprintf(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+version: %s
+releaseName: test
+chartHome: ./charts
+addConfigHashAnnotation: true
+valuesInline:
+  foo: %s
+`, version, foo))
+		require.Len(t, rm.Resources(), 1)
+		hash, ok := rm.Resources()[0].GetAnnotations()["kustomize.helm/config-hash"]
+		require.True(t, ok)
+		require.NotEmpty(t, hash)
+		return hash
+	}
+
+	hash := configHash("1.0.0", "bar")
+	assert.Equal(t, hash, configHash("1.0.0", "bar"))
+	assert.NotEqual(t, hash, configHash("1.0.1", "bar"))
+	assert.NotEqual(t, hash, configHash("1.0.0", "baz"))
+}
+
+// writeFakeHelm writes a shell script standing in for helm, and
+// makes the harness use it.  The script answers 'helm version'
+// itself, and runs the given body for any other command.
+func writeFakeHelm(t *testing.T, th *kusttest_test.HarnessEnhanced, body string) {
+	t.Helper()
+	writeFakeHelmVersion(t, th, "v3.14.2+gc309b6f", body)
+}
+
+// writeFakeHelmVersion is like writeFakeHelm, for a given helm version.
+func writeFakeHelmVersion(
+	t *testing.T, th *kusttest_test.HarnessEnhanced, version, body string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "helm")
+	require.NoError(t, os.WriteFile(path, []byte(`#!/bin/sh
+if [ "$1" = "version" ]; then
+  echo "`+version+`"
+  exit 0
+fi
+`+body), 0700))
+	th.GetPluginConfig().HelmConfig.Command = path
+}
+
+func TestHelmChartInflationGeneratorPullRateLimited(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+
+	attempts := filepath.Join(t.TempDir(), "attempts")
+	writeFakeHelm(t, th, fmt.Sprintf(`
+echo "$1" >> %s
+echo 'Error: failed to authorize: unexpected status: 429 Too Many Requests: toomanyrequests: retry-after: 0' >&2
+exit 1
+`, attempts))
+
+	_, err := th.LoadGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: podinfo
+name: podinfo
+version: 6.2.1
+repo: oci://ghcr.io/stefanprodan/charts
+releaseName: podinfo
+pullRetries: 1
+`).Generate()
+	require.Error(t, err)
+	assert.True(t, types.IsErrRateLimited(err))
+
+	// One pull, and one retry.
+	b, err := os.ReadFile(attempts)
+	require.NoError(t, err)
+	assert.Equal(t, "pull\npull\n", string(b))
+}
+
+func TestHelmChartInflationGeneratorPullTTL(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	th.MkDir("charts")
+	th.MkDir("charts/podinfo-6.2.1")
+	chartDir := th.MkDir("charts/podinfo-6.2.1/podinfo")
+	th.WriteF(filepath.Join(chartDir, "values.yaml"), "")
+	th.WriteF(filepath.Join(chartDir, "stale"), "")
+
+	attempts := filepath.Join(t.TempDir(), "attempts")
+	writeFakeHelm(t, th, fmt.Sprintf(`
+if [ "$1" = "pull" ]; then
+  echo "$1" >> %s
+  while [ $# -gt 0 ]; do
+    if [ "$1" = "--untardir" ]; then
+      mkdir -p "$2/podinfo" && touch "$2/podinfo/values.yaml"
+    fi
+    shift
+  done
+fi
+`, attempts))
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: podinfo
+name: podinfo
+version: 6.2.1
+repo: oci://ghcr.io/stefanprodan/charts
+releaseName: podinfo
+chartHome: ./charts
+pullTTL: 1h
+`
+
+	// A chart younger than the TTL is used as it is.
+	th.LoadAndRunGenerator(config)
+	assert.NoFileExists(t, attempts)
+
+	// An older one is pulled again, and then is fresh.
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(chartDir, old, old))
+	th.LoadAndRunGenerator(config)
+	th.LoadAndRunGenerator(config)
+	b, err := os.ReadFile(attempts)
+	require.NoError(t, err)
+	assert.Equal(t, "pull\n", string(b))
+	assert.NoFileExists(t, filepath.Join(chartDir, "stale"))
+	assert.FileExists(t, filepath.Join(chartDir, "values.yaml"))
+
+	require.ErrorContains(t, th.ErrorFromLoadGenerator(
+		strings.Replace(config, "1h", "-1h", 1)), "pullTTL must be positive")
+}
+
+func TestHelmChartInflationGeneratorHelmFailureHints(t *testing.T) {
+	for name, tc := range map[string]struct {
+		stderr   string
+		expected string
+	}{
+		"unauthorized": {
+			stderr:   "Error: failed to fetch https://charts.example.com/index.yaml : 401 Unauthorized",
+			expected: "(authentication required: set credentialsSecret, or an Authorization header)",
+		},
+		"chart not found": {
+			stderr:   `Error: chart "podinfo" version "9.9.9" not found in https://charts.example.com repository`,
+			expected: "(chart not found: check repo, name and version)",
+		},
+		"other": {
+			stderr:   "Error: something else went wrong",
+			expected: "installed?)",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+				PrepBuiltin("HelmChartInflationGenerator")
+			defer th.Reset()
+
+			writeFakeHelm(t, th, fmt.Sprintf(`
+echo '%s' >&2
+exit 1
+`, tc.stderr))
+			_, err := th.LoadGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: podinfo
+name: podinfo
+version: 9.9.9
+repo: https://charts.example.com
+releaseName: podinfo
+`).Generate()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.expected)
+			// The raw stderr is kept.
+			assert.Contains(t, err.Error(), tc.stderr)
+		})
+	}
+}
+
+func TestHelmChartInflationGeneratorDependencyUpdate(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+	chartDir := filepath.Join(th.GetRoot(), "charts", "test-chart")
+
+	dependency := filepath.Join(t.TempDir(), "dependency")
+	writeFakeHelm(t, th, fmt.Sprintf(`
+if [ "$1" = "dependency" ]; then
+  echo "$2 $3" > %s
+fi
+`, dependency))
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+dependencyUpdate: true
+`
+
+	// Without a lock file, the dependencies are updated.
+	th.LoadAndRunGenerator(config)
+	b, err := os.ReadFile(dependency)
+	require.NoError(t, err)
+	assert.Equal(t, "update "+chartDir+"\n", string(b))
+
+	// With one, the versions it pins are fetched, unless forced.
+	th.WriteF(filepath.Join(chartDir, "Chart.lock"), "dependencies: []\n")
+	th.LoadAndRunGenerator(config)
+	b, err = os.ReadFile(dependency)
+	require.NoError(t, err)
+	assert.Equal(t, "build "+chartDir+"\n", string(b))
+
+	th.LoadAndRunGenerator(config + "forceDependencyUpdate: true\n")
+	b, err = os.ReadFile(dependency)
+	require.NoError(t, err)
+	assert.Equal(t, "update "+chartDir+"\n", string(b))
+
+	require.ErrorContains(t, th.ErrorFromLoadGenerator(
+		strings.Replace(config, "dependencyUpdate", "forceDependencyUpdate", 1)),
+		"forceDependencyUpdate requires dependencyUpdate")
+}
+
+func TestHelmChartInflationGeneratorWorkDir(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+	root, err := filepath.EvalSymlinks(th.GetRoot())
+	require.NoError(t, err)
+
+	workDir := filepath.Join(t.TempDir(), "work-dir")
+	writeFakeHelm(t, th, fmt.Sprintf("pwd -P > %s\n", workDir))
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+`
+
+	th.LoadAndRunGenerator(config)
+	b, err := os.ReadFile(workDir)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, "charts", "test-chart")+"\n", string(b))
+
+	th.MkDir("work")
+	th.LoadAndRunGenerator(config + "workDir: work\n")
+	b, err = os.ReadFile(workDir)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, "work")+"\n", string(b))
+
+	require.ErrorContains(t, th.ErrorFromLoadGenerator(config+"workDir: missing\n"),
+		"/missing' is not a directory")
+}
+
+func TestHelmChartInflationGeneratorMaxErrorBytes(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	// A thousand lines of noise between the first and last lines.
+	writeFakeHelm(t, th, `
+echo 'Error: first line' >&2
+i=0
+while [ $i -lt 1000 ]; do echo 'noise noise noise' >&2; i=$((i+1)); done
+echo 'Error: last line' >&2
+exit 1
+`)
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+`
+
+	_, err := th.LoadGenerator(config).Generate()
+	require.Error(t, err)
+	assert.Greater(t, len(err.Error()), 18000)
+
+	_, err = th.LoadGenerator(config + "maxErrorBytes: 200\n").Generate()
+	require.Error(t, err)
+	assert.Less(t, len(err.Error()), 2000)
+	assert.Contains(t, err.Error(), "Error: first line")
+	assert.Contains(t, err.Error(), "Error: last line")
+	assert.Contains(t, err.Error(), "\n[truncated 17835 bytes]\n")
+
+	require.ErrorContains(t, th.ErrorFromLoadGenerator(config+"maxErrorBytes: -1\n"),
+		"maxErrorBytes cannot be negative")
+}
+
+func TestHelmChartInflationGeneratorWarnIfOutdated(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	th.MkDir("charts")
+	th.MkDir("charts/podinfo-6.2.1")
+	th.WriteF(filepath.Join(th.MkDir("charts/podinfo-6.2.1/podinfo"), "values.yaml"), "")
+
+	showArgs := filepath.Join(t.TempDir(), "show-args")
+	writeFakeHelm(t, th, fmt.Sprintf(`
+if [ "$1" = "show" ]; then
+  echo "$@" > %s
+  cat <<EOT
+apiVersion: v2
+name: podinfo
+version: $LATEST
+EOT
+fi
+`, showArgs))
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: podinfo
+name: podinfo
+version: 6.2.1
+repo: https://stefanprodan.github.io/podinfo
+releaseName: podinfo
+chartHome: ./charts
+warnIfOutdated: true
+`
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	t.Setenv("LATEST", "6.10.0")
+	th.LoadAndRunGenerator(config)
+	assert.Contains(t, logs.String(),
+		"warning: helm chart 'podinfo' is pinned to version 6.2.1, "+
+			"but 6.10.0 is available in https://stefanprodan.github.io/podinfo")
+	b, err := os.ReadFile(showArgs)
+	require.NoError(t, err)
+	assert.Equal(t, "show chart --repo https://stefanprodan.github.io/podinfo podinfo\n", string(b))
+
+	logs.Reset()
+	t.Setenv("LATEST", "6.2.1")
+	th.LoadAndRunGenerator(config)
+	assert.NotContains(t, logs.String(), "is pinned to version")
+}
+
+func TestHelmChartInflationGeneratorTemplateRetries(t *testing.T) {
+	for name, tc := range map[string]struct {
+		stderr   string
+		attempts string
+	}{
+		"transient": {
+			stderr:   "Error: Get \"https://10.0.0.1:6443/api\": dial tcp 10.0.0.1:6443: connect: connection refused",
+			attempts: "template\ntemplate\ntemplate\n",
+		},
+		"deterministic": {
+			stderr:   "Error: template: test-chart/templates/cm.yaml:3:3: executing: nil pointer",
+			attempts: "template\n",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+				PrepBuiltin("HelmChartInflationGenerator")
+			defer th.Reset()
+			copyTestChartsIntoHarness(t, th)
+
+			attempts := filepath.Join(t.TempDir(), "attempts")
+			writeFakeHelm(t, th, fmt.Sprintf(`
+echo "$1" >> %s
+echo '%s' >&2
+exit 1
+`, attempts, tc.stderr))
+			_, err := th.LoadGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+templateRetries: 2
+`).Generate()
+			require.ErrorContains(t, err, tc.stderr)
+			b, err := os.ReadFile(attempts)
+			require.NoError(t, err)
+			assert.Equal(t, tc.attempts, string(b))
+		})
+	}
+}
+
+func TestHelmChartInflationGeneratorWithTLSCABundle(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+	th.WriteF(filepath.Join(th.GetRoot(), "proxy-ca.pem"), "not a real bundle")
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: env
+data:
+  SSL_CERT_FILE: "$SSL_CERT_FILE"
+EOT
+`)
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+tlsCABundle: proxy-ca.pem
+`)
+
+	certFile, err := rm.Resources()[0].GetFieldValue("data.SSL_CERT_FILE")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(th.GetRoot(), "proxy-ca.pem"), certFile)
+}
+
+func TestHelmChartInflationGeneratorGenerateAndDiff(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	if err := th.ErrIfNoHelm(); err != nil {
+		t.Skip("skipping: " + err.Error())
+	}
+	copyTestChartsIntoHarness(t, th)
+	th.WriteF(filepath.Join(th.GetRoot(), "previous.yaml"), `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+`)
+
+	g := th.LoadGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+diffAgainst: previous.yaml
+`)
+	differ, ok := g.(interface {
+		GenerateAndDiff() (resmap.ResMap, []resmap.ResourceChange, error)
+	})
+	require.True(t, ok)
+
+	rm, changes, err := differ.GenerateAndDiff()
+	require.NoError(t, err)
+	require.Len(t, rm.Resources(), 1)
+	assert.Equal(t, []resmap.ResourceChange{
+		{Id: rm.Resources()[0].CurId(), Type: resmap.ChangeAdded},
+		{Id: resid.NewResId(resid.NewGvk("", "v1", "ConfigMap"), "foo"), Type: resmap.ChangeRemoved},
+	}, changes)
+}
+
+func TestHelmChartInflationGeneratorWithStrictParse(t *testing.T) {
+	const helmOutput = `Pulled: example.com/charts/test-chart:1.0.0
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: bar
+`
+	_, parseErr := resmap.NewFactory(
+		provider.NewDefaultDepProvider().GetResourceFactory()).
+		NewResMapFromBytes([]byte(helmOutput))
+	require.Error(t, parseErr)
+
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strictParse=%t", strict), func(t *testing.T) {
+			th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+				PrepBuiltin("HelmChartInflationGenerator")
+			defer th.Reset()
+			copyTestChartsIntoHarness(t, th)
+			writeFakeHelm(t, th, "cat <<'EOT'\n"+helmOutput+"EOT\n")
+
+			rm, err := th.LoadGenerator(fmt.Sprintf(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+strictParse: %t
+`, strict)).Generate()
+			if strict {
+				require.EqualError(t, err, parseErr.Error())
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, rm.Resources(), 1)
+		})
+	}
+}
+
+func TestHelmChartInflationGeneratorWithNamePrefixAndSuffix(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	if err := th.ErrIfNoHelm(); err != nil {
+		t.Skip("skipping: " + err.Error())
+	}
+	copyTestChartsIntoHarness(t, th)
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+namePrefix: team-
+nameSuffix: -v1
+`)
+
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: team-bar-v1
+`)
+}
+
+// chartArchive returns the base64 encoded .tgz of a test chart,
+// laid out like the archives produced by 'helm package'.
+func chartArchive(t *testing.T, chart string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	root := filepath.Join("testdata/charts", chart)
+	require.NoError(t, filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if err = tw.WriteHeader(&tar.Header{
+			Name: filepath.ToSlash(filepath.Join(chart, rel)),
+			Mode: 0644,
+			Size: int64(len(b)),
+		}); err != nil {
+			return err
+		}
+		_, err = tw.Write(b)
+		return err
+	}))
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestHelmChartInflationGeneratorWithChartFromResource(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	if err := th.ErrIfNoHelm(); err != nil {
+		t.Skip("skipping: " + err.Error())
+	}
+	th.WriteF(filepath.Join(th.GetRoot(), "chart-configmap.yaml"), `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: test-chart
+binaryData:
+  test-chart-1.0.0.tgz: `+chartArchive(t, "test-chart")+`
+`)
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartFromResource:
+  path: chart-configmap.yaml
+  key: test-chart-1.0.0.tgz
+valuesInline:
+  foo: from-resource
+`)
+
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: from-resource
+`)
+	// Nothing is pulled into, or expected in, the chart home.
+	assert.False(t, th.GetFSys().Exists(filepath.Join(th.GetRoot(), "charts")))
+}
+
+func TestHelmChartInflationGeneratorWithSkipCRDs(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	if err := th.ErrIfNoHelm(); err != nil {
+		t.Skip("skipping: " + err.Error())
+	}
+	copyTestChartsIntoHarness(t, th)
+
+	// The chart has a CRD in its crds directory, which helm
+	// leaves out by default, and another in its templates.
+	rm := th.LoadAndRunGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: crds
+name: crds
+releaseName: test
+chartHome: ./charts
+skipCRDs: true
+`)
+
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: bar
+`)
+}
+
+func TestHelmChartInflationGeneratorPreflight(t *testing.T) {
+	testCases := map[string]struct {
+		// helm is the body of a fake helm script, or empty to use
+		// a helm that doesn't exist.  The missing helm is given as a
+		// path, as a bare name not in PATH fails configuration.
+		helm       string
+		configHome string
+		expected   []string
+	}{
+		"all checks pass": {
+			helm: `
+if [ "$1" = "version" ]; then echo "v3.14.2+gc309b6f"; fi
+`,
+		},
+		"helm missing": {
+			expected: []string{"- helm: ", "/missing-helm' installed?"},
+		},
+		"helm v2": {
+			helm: `
+if [ "$1" = "version" ]; then echo "v2.17.0+ga690bad"; fi
+`,
+			expected: []string{"- helm: this plugin requires helm V3 but got v2.17.0"},
+		},
+		"repo unreachable and configHome not writable": {
+			helm: `
+if [ "$1" = "version" ]; then echo "v3.14.2+gc309b6f"; exit 0; fi
+echo 'Error: dial tcp: lookup ghcr.io: no such host' >&2
+exit 1
+`,
+			configHome: "not-a-dir/helm",
+			expected: []string{
+				"- configHome: ",
+				"- repo: oci://ghcr.io/stefanprodan/charts unreachable: ",
+				"no such host",
+			},
+		},
+		"auth rejected": {
+			helm: `
+if [ "$1" = "version" ]; then echo "v3.14.2+gc309b6f"; exit 0; fi
+echo 'Error: unexpected status from HEAD request: 401 Unauthorized' >&2
+exit 1
+`,
+			expected: []string{"- auth: access to oci://ghcr.io/stefanprodan/charts denied: "},
+		},
+		"repo hangs": {
+			helm: `
+if [ "$1" = "version" ]; then echo "v3.14.2+gc309b6f"; exit 0; fi
+sleep 30
+`,
+			expected: []string{
+				"- repo: oci://ghcr.io/stefanprodan/charts unreachable: ",
+				"context deadline exceeded",
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+				PrepBuiltin("HelmChartInflationGenerator")
+			defer th.Reset()
+			th.GetPluginConfig().HelmConfig.Command = filepath.Join(t.TempDir(), "missing-helm")
+			if tc.helm != "" {
+				path := filepath.Join(t.TempDir(), "helm")
+				require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+tc.helm), 0700))
+				th.GetPluginConfig().HelmConfig.Command = path
+			}
+			th.WriteF(filepath.Join(th.GetRoot(), "not-a-dir"), "")
+			configHome := filepath.Join(th.GetRoot(), "helm")
+			if tc.configHome != "" {
+				configHome = filepath.Join(th.GetRoot(), tc.configHome)
+			}
+
+			g := th.LoadGenerator(fmt.Sprintf(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: podinfo
+name: podinfo
+version: 6.2.1
+repo: oci://ghcr.io/stefanprodan/charts
+releaseName: podinfo
+configHome: %s
+`, configHome))
+			checker, ok := g.(interface {
+				Preflight() error
+				SetPreflightTimeout(d time.Duration)
+			})
+			require.True(t, ok)
+			checker.SetPreflightTimeout(time.Second)
+
+			err := checker.Preflight()
+			if len(tc.expected) == 0 {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			for _, s := range tc.expected {
+				assert.Contains(t, err.Error(), s)
+			}
+		})
+	}
+}
+
+func TestHelmChartInflationGeneratorWithKindPriority(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: a
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: c
+EOT
+`)
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+kindPriority:
+  Namespace: 0
+  CustomResourceDefinition: 1
+`)
+
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: c
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: a
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b
+`)
+}
+
+// stubTransport answers every request with the body
+// it holds for the URL, recording the URLs requested.
+type stubTransport struct {
+	bodies    map[string]string
+	requested []string
+}
+
+func (s *stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s.requested = append(s.requested, req.URL.String())
+	body, ok := s.bodies[req.URL.String()]
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusNotFound
+	}
+	return &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func TestHelmChartInflationGeneratorSetHTTPClient(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	// Render the values helm is given.
+	writeFakeHelm(t, th, `
+while [ $# -gt 0 ]; do
+  if [ "$1" = "-f" ]; then values="$2"; fi
+  shift
+done
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: values
+data:
+  values.yaml: |
+EOT
+sed 's/^/    /' "$values"
+`)
+
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+valuesFile: %s
+`
+	stub := &stubTransport{bodies: map[string]string{
+		"https://values.example.com/values.yaml": "foo: stubbed\n",
+	}}
+	generate := func(url string) (resmap.ResMap, error) {
+		t.Helper()
+		g := th.LoadGenerator(fmt.Sprintf(config, url))
+		setter, ok := g.(interface{ SetHTTPClient(*http.Client) })
+		require.True(t, ok)
+		setter.SetHTTPClient(&http.Client{Transport: stub})
+		return g.Generate()
+	}
+
+	rm, err := generate("https://values.example.com/values.yaml")
+	require.NoError(t, err)
+	rm.RemoveBuildAnnotations()
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+data:
+  values.yaml: |
+    foo: stubbed
+kind: ConfigMap
+metadata:
+  name: values
+`)
+
+	_, err = generate("https://values.example.com/missing.yaml")
+	require.ErrorContains(t, err,
+		"could not download 'https://values.example.com/missing.yaml': Not Found")
+	assert.Contains(t, stub.requested, "https://values.example.com/missing.yaml")
+}
+
+func TestHelmChartInflationGeneratorWithKeyringURL(t *testing.T) {
+	const keyring = "not a real keyring"
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			fmt.Fprint(w, keyring)
+		}))
+	defer server.Close()
+
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+
+	dir := t.TempDir()
+	pullArgs := filepath.Join(dir, "pull-args")
+	pulledKeyring := filepath.Join(dir, "keyring")
+	writeFakeHelm(t, th, fmt.Sprintf(`
+if [ "$1" = "pull" ]; then
+  echo "$@" > %s
+  while [ $# -gt 0 ]; do
+    case "$1" in
+      --untardir) mkdir -p "$2/podinfo" && touch "$2/podinfo/values.yaml";;
+      --keyring) cp "$2" %s;;
+    esac
+    shift
+  done
+fi
+`, pullArgs, pulledKeyring))
+
+	g := th.LoadGenerator(fmt.Sprintf(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: podinfo
+name: podinfo
+version: 6.2.1
+repo: oci://ghcr.io/stefanprodan/charts
+releaseName: podinfo
+keyringURL: %s/pubring.gpg
+`, server.URL))
+	_, err := g.Generate()
+	require.NoError(t, err)
+
+	b, err := os.ReadFile(pullArgs)
+	require.NoError(t, err)
+	assert.Regexp(t, ` --verify --keyring \S+/keyring.gpg `, string(b))
+	b, err = os.ReadFile(pulledKeyring)
+	require.NoError(t, err)
+	assert.Equal(t, keyring, string(b))
+
+	// The keyring went with the last run's tmp dir; a new pull needs it again.
+	require.NoError(t, os.RemoveAll(filepath.Join(th.GetRoot(), "charts")))
+	require.NoError(t, os.Remove(pulledKeyring))
+	_, err = g.Generate()
+	require.NoError(t, err)
+	b, err = os.ReadFile(pulledKeyring)
+	require.NoError(t, err)
+	assert.Equal(t, keyring, string(b))
+}
+
+func TestHelmChartInflationGeneratorInlineAlwaysWins(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+	th.WriteF(filepath.Join(th.GetRoot(), "values.yaml"), "replicas: 1\nimage: base\n")
+	th.WriteF(filepath.Join(th.GetRoot(), "prod.yaml"), "replicas: 2\n")
+
+	// Report the replicas and image of the last values file to set them.
+	writeFakeHelm(t, th, `
+while [ $# -gt 0 ]; do
+  if [ "$1" = "-f" ]; then
+    v="$(sed -n 's/^replicas: //p' "$2")"
+    if [ -n "$v" ]; then replicas="$v"; fi
+    v="$(sed -n 's/^image: //p' "$2")"
+    if [ -n "$v" ]; then image="$v"; fi
+  fi
+  shift
+done
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: values
+data:
+  image: "$image"
+  replicas: "$replicas"
+EOT
+`)
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+valuesFile: values.yaml
+additionalValuesFiles:
+- prod.yaml
+valuesInline:
+  replicas: 3
+`
+	expected := func(replicas string) string {
+		return `apiVersion: v1
+data:
+  image: base
+  replicas: "` + replicas + `"
+kind: ConfigMap
+metadata:
+  name: values
+`
+	}
+
+	th.AssertActualEqualsExpected(th.LoadAndRunGenerator(config), expected("2"))
+	th.AssertActualEqualsExpected(
+		th.LoadAndRunGenerator(config+"inlineAlwaysWins: true\n"), expected("3"))
+	th.AssertActualEqualsExpected(
+		th.LoadAndRunGenerator(strings.Replace(config, "valuesInline:\n  replicas: 3\n", "", 1)+
+			"inlineAlwaysWins: true\n"), expected("2"))
+
+	require.ErrorContains(t, th.ErrorFromLoadGenerator(
+		config+"inlineAlwaysWins: true\nvaluesMerge: merge\n"),
+		"inlineAlwaysWins can't be combined with valuesMerge 'merge'")
+}
+
+func TestHelmChartInflationGeneratorWithMergeBaseFile(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+	th.WriteF(filepath.Join(th.GetRoot(), "values.yaml"), "replicas: 1\nimage: base\n")
+	th.WriteF(filepath.Join(th.GetRoot(), "env.yaml"), "replicas: 2\nimage: env\n")
+
+	// Render the values files helm is given, in order.
+	writeFakeHelm(t, th, `
+n=0
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: values
+data:
+EOT
+while [ $# -gt 0 ]; do
+  if [ "$1" = "-f" ]; then
+    n=$((n+1))
+    echo "  values$n.yaml: |"
+    sed 's/^/    /' "$2"
+  fi
+  shift
+done
+`)
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+valuesFile: values.yaml
+mergeBaseFile: env.yaml
+valuesInline:
+  replicas: 3
+`
+	th.AssertActualEqualsExpected(th.LoadAndRunGenerator(config), `
+apiVersion: v1
+data:
+  values1.yaml: |
+    replicas: 1
+    image: base
+  values2.yaml: |
+    image: env
+    replicas: 3
+kind: ConfigMap
+metadata:
+  name: values
+`)
+	th.AssertActualEqualsExpected(th.LoadAndRunGenerator(config+"valuesMerge: merge\n"), `
+apiVersion: v1
+data:
+  values1.yaml: |
+    replicas: 1
+    image: base
+  values2.yaml: |
+    image: env
+    replicas: 2
+kind: ConfigMap
+metadata:
+  name: values
+`)
+
+	require.ErrorContains(t, th.ErrorFromLoadGenerator(
+		config+"valuesMerge: replace\n"),
+		"mergeBaseFile can't be combined with valuesMerge 'replace'")
+	require.ErrorContains(t, th.ErrorFromLoadGenerator(
+		strings.Replace(config, "env.yaml", "missing.yaml", 1)),
+		"could not load mergeBaseFile")
+}
+
+func TestHelmChartInflationGeneratorWithValuesOverlays(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	// Render the values helm is given.
+	writeFakeHelm(t, th, `
+while [ $# -gt 0 ]; do
+  if [ "$1" = "-f" ]; then values="$2"; fi
+  shift
+done
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: values
+data:
+  values.yaml: |
+EOT
+sed 's/^/    /' "$values"
+`)
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+valuesInline:
+  subchartA:
+    enabled: true
+    component:
+      image: nginx
+      replicas: 1
+valuesOverlays:
+- path: subchartA.component
+  values:
+    replicas: 3
+    resources:
+      limits:
+        cpu: 100m
+- path: subchartB.component
+  values:
+    image: redis
+`)
+
+	values, err := rm.Resources()[0].GetFieldValue("data.values\\.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, `foo: bar
+subchartA:
+  component:
+    image: nginx
+    replicas: 3
+    resources:
+      limits:
+        cpu: 100m
+  enabled: true
+subchartB:
+  component:
+    image: redis
+`, values)
+}
+
+func TestHelmChartInflationGeneratorWithSubchartValuesFiles(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+	th.WriteF(filepath.Join(th.GetRoot(), "values-db.yaml"), `
+auth:
+  database: app
+replicas: 2
+`)
+
+	// Render the values helm is given.
+	writeFakeHelm(t, th, `
+while [ $# -gt 0 ]; do
+  if [ "$1" = "-f" ]; then values="$2"; fi
+  shift
+done
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: values
+data:
+  values.yaml: |
+EOT
+sed 's/^/    /' "$values"
+`)
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+valuesInline:
+  postgresql:
+    enabled: true
+valuesOverlays:
+- path: postgresql
+  values:
+    replicas: 3
+subchartValuesFiles:
+  %s: values-db.yaml
+`
+
+	rm := th.LoadAndRunGenerator(fmt.Sprintf(config, "postgresql"))
+	values, err := rm.Resources()[0].GetFieldValue("data.values\\.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, `foo: bar
+postgresql:
+  auth:
+    database: app
+  enabled: true
+  replicas: 3
+`, values)
+
+	require.ErrorContains(t, th.ErrorFromLoadGenerator(fmt.Sprintf(config, "a.b")),
+		"invalid subchartValuesFiles subchart 'a.b'")
+}
+
+func TestHelmChartInflationGeneratorWithCacheDir(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+	cacheDir := t.TempDir()
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: env
+data:
+  HELM_CONFIG_HOME: "$HELM_CONFIG_HOME"
+EOT
+`)
+	configHome := func(version string) string {
+		t.Helper()
+		rm := th.LoadAndRunGenerator(fmt.Sprintf(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+version: %s
+releaseName: test
+chartHome: ./charts
+cacheDir: %s
+`, version, cacheDir))
+		dir, err := rm.Resources()[0].GetFieldValue("data.HELM_CONFIG_HOME")
+		require.NoError(t, err)
+		return dir.(string)
+	}
+
+	dir := configHome("1.0.0")
+	assert.Equal(t, cacheDir, filepath.Dir(filepath.Dir(dir)))
+	assert.Equal(t, dir, configHome("1.0.0"))
+	assert.NotEqual(t, dir, configHome("1.0.1"))
+
+	// The dir is kept for the next build, and unlocked.
+	assert.DirExists(t, filepath.Dir(dir))
+	assert.NoFileExists(t, filepath.Dir(dir)+".lock")
+}
+
+func TestHelmChartInflationGeneratorWithCreateNamespace(t *testing.T) {
+	testCases := map[string]struct {
+		helmOutput string
+		expected   string
+	}{
+		"namespace missing": {
+			helmOutput: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+  namespace: apps
+`,
+			expected: `
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: apps
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+  namespace: apps
+`,
+		},
+		"namespace present": {
+			helmOutput: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+  namespace: apps
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: apps
+  labels:
+    from: chart
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+  namespace: apps
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  labels:
+    from: chart
+  name: apps
+`,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+				PrepBuiltin("HelmChartInflationGenerator")
+			defer th.Reset()
+			copyTestChartsIntoHarness(t, th)
+			writeFakeHelm(t, th, "cat <<EOT"+tc.helmOutput+"EOT\n")
+
+			rm := th.LoadAndRunGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+namespace: apps
+chartHome: ./charts
+createNamespace: true
+`)
+			th.AssertActualEqualsExpected(rm, tc.expected)
+		})
+	}
+}
+
+func TestHelmChartInflationGeneratorWithAllowedImageRegistries(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      initContainers:
+      - name: init
+        image: busybox:1.36
+      containers:
+      - name: app
+        image: registry.example.com/team/app:1.0.0
+      - name: proxy
+        image: quay.io/proxy/envoy:v1.29
+EOT
+`)
+
+	_, err := th.LoadGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+allowedImageRegistries:
+- registry.example.com
+- index.docker.io
+`).Generate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "image 'quay.io/proxy/envoy:v1.29' is from registry 'quay.io'")
+	assert.NotContains(t, err.Error(), "busybox")
+	assert.NotContains(t, err.Error(), "registry.example.com/team/app")
+}
+
+func TestHelmChartInflationGeneratorWithHelmCommand(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+EOT
+`)
+	// Leave only the chart's own command.
+	helm := th.GetPluginConfig().HelmConfig.Command
+	th.GetPluginConfig().HelmConfig.Command = ""
+
+	rm := th.LoadAndRunGenerator(fmt.Sprintf(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+helmCommand: %s
+`, helm))
+
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+`)
+}
+
+// recordingFactory is a ResMap factory that keeps a copy of what
+// it's asked to parse.
+type recordingFactory struct {
+	*resmap.Factory
+	inputs []string
+}
+
+func (f *recordingFactory) NewResMapFromBytes(b []byte) (resmap.ResMap, error) {
+	f.inputs = append(f.inputs, string(b))
+	return f.Factory.NewResMapFromBytes(b)
+}
+
+func TestHelmChartInflationGeneratorWithResMapFactory(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	const helmOutput = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+`
+	writeFakeHelm(t, th, "cat <<EOT\n"+helmOutput+"EOT\n")
+
+	g := th.LoadGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+`)
+	setter, ok := g.(interface {
+		SetResMapFactory(interface {
+			NewResMapFromBytes(b []byte) (resmap.ResMap, error)
+			NewResMapFromRNodeSlice(s []*yaml.RNode) (resmap.ResMap, error)
+		})
+	})
+	require.True(t, ok)
+	factory := &recordingFactory{
+		Factory: resmap.NewFactory(provider.NewDefaultDepProvider().GetResourceFactory()),
+	}
+	setter.SetResMapFactory(factory)
+
+	rm, err := g.Generate()
+	require.NoError(t, err)
+	assert.Equal(t, []string{helmOutput}, factory.inputs)
+	th.AssertActualEqualsExpected(rm, helmOutput)
+}
+
+func TestHelmChartInflationGeneratorWithSkipSchemaValidation(t *testing.T) {
+	testCases := map[string]struct {
+		helmVersion string
+		expectedErr string
+	}{
+		"helm with the flag": {
+			helmVersion: "v3.16.1+g5a5449d",
+		},
+		"helm without the flag": {
+			helmVersion: "v3.15.4+gfa9efb0",
+			expectedErr: "skipSchemaValidation requires helm v3.16.0 or later but got v3.15.4",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+				PrepBuiltin("HelmChartInflationGenerator")
+			defer th.Reset()
+			copyTestChartsIntoHarness(t, th)
+
+			templateArgs := filepath.Join(t.TempDir(), "template-args")
+			writeFakeHelmVersion(t, th, tc.helmVersion,
+				fmt.Sprintf("echo \"$@\" > %s\n", templateArgs))
+
+			_, err := th.LoadGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+skipSchemaValidation: true
+`).Generate()
+			if tc.expectedErr != "" {
+				require.ErrorContains(t, err, tc.expectedErr)
+				assert.NoFileExists(t, templateArgs)
+				return
+			}
+			require.NoError(t, err)
+			b, err := os.ReadFile(templateArgs)
+			require.NoError(t, err)
+			assert.Contains(t, string(b), " --skip-schema-validation")
+		})
+	}
+}
+
+func TestHelmChartInflationGeneratorWithExtraResources(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+	th.WriteF(filepath.Join(th.GetRoot(), "networkpolicy.yaml"), `
+apiVersion: networking.k8s.io/v1
+kind: NetworkPolicy
+metadata:
+  name: deny-all
+spec:
+  podSelector: {}
+  policyTypes:
+  - Ingress
+`)
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+EOT
+`)
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+extraResources:
+- networkpolicy.yaml
+- |
+  apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: %s
+`
+
+	rm := th.LoadAndRunGenerator(fmt.Sprintf(config, "bar"))
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+---
+apiVersion: networking.k8s.io/v1
+kind: NetworkPolicy
+metadata:
+  name: deny-all
+spec:
+  podSelector: {}
+  policyTypes:
+  - Ingress
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: bar
+`)
+
+	_, err := th.LoadGenerator(fmt.Sprintf(config, "foo")).Generate()
+	require.ErrorContains(t, err, "could not add extraResources")
+}
+
+func TestHelmChartInflationGeneratorWithExtraResourcesCollision(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+data:
+  a: chart
+  b: chart
+EOT
+`)
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+extraResourcesCollision: %s
+extraResources:
+- |
+  apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: foo
+  data:
+    b: extra
+    c: extra
+`
+	for _, tc := range []struct {
+		collision string
+		expected  string
+	}{
+		{
+			collision: "extra-wins",
+			expected: `
+apiVersion: v1
+data:
+  b: extra
+  c: extra
+kind: ConfigMap
+metadata:
+  name: foo
+`,
+		},
+		{
+			collision: "chart-wins",
+			expected: `
+apiVersion: v1
+data:
+  a: chart
+  b: chart
+kind: ConfigMap
+metadata:
+  name: foo
+`,
+		},
+		{
+			collision: "merge",
+			expected: `
+apiVersion: v1
+data:
+  a: chart
+  b: extra
+  c: extra
+kind: ConfigMap
+metadata:
+  name: foo
+`,
+		},
+	} {
+		t.Run(tc.collision, func(t *testing.T) {
+			rm := th.LoadAndRunGenerator(fmt.Sprintf(config, tc.collision))
+			th.AssertActualEqualsExpected(rm, tc.expected)
+		})
+	}
+
+	_, err := th.LoadGenerator(fmt.Sprintf(config, "error")).Generate()
+	require.ErrorContains(t, err, "could not add extraResources")
+	require.ErrorContains(t, th.ErrorFromLoadGenerator(fmt.Sprintf(config, "replace")),
+		"extraResourcesCollision must be one of [error extra-wins chart-wins merge]")
+}
+
+func TestHelmChartInflationGeneratorWithHelmLabels(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+helmLabels:
+  team: web
+`
+
+	templateArgs := filepath.Join(t.TempDir(), "template-args")
+	writeFakeHelm(t, th, fmt.Sprintf("echo \"$@\" > %s\n", templateArgs))
+	th.LoadAndRunGenerator(config)
+	b, err := os.ReadFile(templateArgs)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), " --labels team=web")
+
+	writeFakeHelmVersion(t, th, "v3.12.3+g3a31588", "")
+	_, err = th.LoadGenerator(config).Generate()
+	require.ErrorContains(t, err, "helmLabels requires helm v3.13.0 or later but got v3.12.3")
+}
+
+func TestHelmChartInflationGeneratorExplicitCRDs(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+includeCRDs: %t
+`
+
+	templateArgs := filepath.Join(t.TempDir(), "template-args")
+	for _, version := range []string{"v3.1.3+g0a9a9a8", "v3.14.2+gc309b6f"} {
+		writeFakeHelmVersion(t, th, version, fmt.Sprintf("echo \"$@\" > %s\n", templateArgs))
+		th.LoadAndRunGenerator(fmt.Sprintf(config, false))
+		b, err := os.ReadFile(templateArgs)
+		require.NoError(t, err)
+		assert.Contains(t, string(b), " --skip-crds", version)
+		assert.NotContains(t, string(b), " --include-crds", version)
+
+		th.LoadAndRunGenerator(fmt.Sprintf(config, true))
+		b, err = os.ReadFile(templateArgs)
+		require.NoError(t, err)
+		assert.Contains(t, string(b), " --include-crds", version)
+		assert.NotContains(t, string(b), " --skip-crds", version)
+	}
+
+	writeFakeHelmVersion(t, th, "v3.0.3+gac925eb", "")
+	_, err := th.LoadGenerator(fmt.Sprintf(config, false)).Generate()
+	require.ErrorContains(t, err, "helm v3.0.3 has no --include-crds and --skip-crds flags "+
+		"for template, so whether it renders CRDs can't be made explicit; "+
+		"this plugin requires helm v3.1.0 or later")
+}
+
+func TestHelmChartInflationGeneratorWithRecordWarningsAnnotation(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	writeFakeHelm(t, th, `
+echo 'WARNING: This chart is deprecated' >&2
+echo 'coalesce.go:286: warning: cannot overwrite table with non table for foo' >&2
+echo 'some other output' >&2
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: bar
+EOT
+`)
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+recordWarningsAnnotation: true
+`)
+
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  annotations:
+    kustomize.helm/warnings: |-
+      WARNING: This chart is deprecated
+      coalesce.go:286: warning: cannot overwrite table with non table for foo
+  name: foo
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: bar
+`)
+}
+
+func TestHelmChartInflationGeneratorWithObjectStoreRepo(t *testing.T) {
+	for _, repo := range []string{"s3://my-bucket/charts", "gs://my-bucket/charts"} {
+		t.Run(repo, func(t *testing.T) {
+			th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+				PrepBuiltin("HelmChartInflationGenerator")
+			defer th.Reset()
+
+			pull := filepath.Join(t.TempDir(), "pull")
+			writeFakeHelm(t, th, fmt.Sprintf(`
+case "$1" in
+  env) echo /home/user/.local/share/helm/plugins;;
+  pull)
+    echo "$@" "HELM_PLUGINS=$HELM_PLUGINS" > %s
+    mkdir -p "$4/mychart" && touch "$4/mychart/values.yaml";;
+esac
+`, pull))
+
+			th.LoadAndRunGenerator(fmt.Sprintf(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: mychart
+name: mychart
+version: 1.0.0
+repo: %s
+releaseName: test
+`, repo))
+
+			b, err := os.ReadFile(pull)
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf(
+				"pull --untar --untardir %s --repo %s mychart --version 1.0.0 "+
+					"HELM_PLUGINS=/home/user/.local/share/helm/plugins\n",
+				filepath.Join(th.GetRoot(), "charts", "mychart-1.0.0"), repo), string(b))
+		})
+	}
+}
+
+func TestHelmChartInflationGeneratorEnsurePulled(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+
+	log := filepath.Join(t.TempDir(), "log")
+	writeFakeHelm(t, th, fmt.Sprintf(`
+echo "$1 $HELM_CONFIG_HOME" >> %s
+if [ "$1" = "pull" ]; then
+  mkdir -p "$4/podinfo" && touch "$4/podinfo/Chart.yaml"
+fi
+`, log))
+
+	g := th.LoadGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: podinfo
+name: podinfo
+version: 6.2.1
+repo: oci://ghcr.io/stefanprodan/charts
+releaseName: podinfo
+`)
+	puller, ok := g.(interface{ EnsurePulled() (string, error) })
+	require.True(t, ok)
+
+	path, err := puller.EnsurePulled()
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(th.GetRoot(), "charts", "podinfo-6.2.1", "podinfo"), path)
+	assert.FileExists(t, filepath.Join(path, "Chart.yaml"))
+
+	// Only the pull ran, and the tmp dir holding
+	// HELM_CONFIG_HOME was removed afterwards.
+	b, err := os.ReadFile(log)
+	require.NoError(t, err)
+	command, configHome, _ := strings.Cut(strings.TrimSpace(string(b)), " ")
+	assert.Equal(t, "pull", command)
+	assert.NoDirExists(t, filepath.Dir(configHome))
+}
+
+func TestHelmChartInflationGeneratorWithExcludeByLabels(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: v1
+kind: Pod
+metadata:
+  name: test-connection
+  labels:
+    app.kubernetes.io/name: app
+    app.kubernetes.io/component: test
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+  labels:
+    app.kubernetes.io/name: app
+    app.kubernetes.io/component: server
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: test-config
+  labels:
+    app.kubernetes.io/component: test
+EOT
+`)
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+excludeByLabels:
+  app.kubernetes.io/name: app
+  app.kubernetes.io/component: test
+`)
+
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+kind: Service
+metadata:
+  labels:
+    app.kubernetes.io/component: server
+    app.kubernetes.io/name: app
+  name: app
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  labels:
+    app.kubernetes.io/component: test
+  name: test-config
+`)
+}
+
+func TestHelmChartInflationGeneratorWithExcludeResources(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: default
+  namespace: apps
+---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: app
+  namespace: apps
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: default
+  namespace: apps
+EOT
+`)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	rm := th.LoadAndRunGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+excludeResources:
+- kind: ServiceAccount
+  name: default
+  namespace: apps
+- kind: Secret
+  name: default
+warnOnUnmatchedExcludes: true
+`)
+
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: app
+  namespace: apps
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: default
+  namespace: apps
+`)
+	assert.Contains(t, logs.String(),
+		"warning: helm chart 'test-chart' has no Secret 'default' to exclude")
+	assert.NotContains(t, logs.String(), "ServiceAccount")
+}
+
+func TestHelmChartInflationGeneratorRenderCanonical(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	// Emit the same resources, but in a different order,
+	// and with differently ordered fields, on each run.
+	runs := filepath.Join(t.TempDir(), "runs")
+	writeFakeHelm(t, th, fmt.Sprintf(`
+if [ -f %[1]s ]; then
+cat <<EOT
+kind: Service
+apiVersion: v1
+metadata:
+  name: app
+---
+apiVersion: v1
+kind: ConfigMap
+data:
+  b: "2"
+  a: "1"
+metadata:
+  name: app
+EOT
+else
+touch %[1]s
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+data:
+  a: "1"
+  b: "2"
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+EOT
+fi
+`, runs))
+
+	render := func() ([]byte, string) {
+		t.Helper()
+		g := th.LoadGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+`)
+		renderer, ok := g.(interface {
+			RenderCanonical() ([]byte, string, error)
+		})
+		require.True(t, ok)
+		b, hash, err := renderer.RenderCanonical()
+		require.NoError(t, err)
+		return b, hash
+	}
+
+	b, hash := render()
+	assert.Equal(t, `apiVersion: v1
+data:
+  a: "1"
+  b: "2"
+kind: ConfigMap
+metadata:
+  name: app
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+`, string(b))
+	sum := sha256.Sum256(b)
+	assert.Equal(t, hex.EncodeToString(sum[:]), hash)
+
+	b2, hash2 := render()
+	assert.Equal(t, string(b), string(b2))
+	assert.Equal(t, hash, hash2)
+}
+
+func TestHelmChartInflationGeneratorRenderCanonicalCompressed(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+data:
+  a: "1"
+EOT
+`)
+	type renderer interface {
+		RenderCanonical() ([]byte, string, error)
+		RenderCanonicalCompressed() ([]byte, string, error)
+	}
+	load := func() renderer {
+		t.Helper()
+		g := th.LoadGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+`)
+		r, ok := g.(renderer)
+		require.True(t, ok)
+		return r
+	}
+	b, hash, err := load().RenderCanonical()
+	require.NoError(t, err)
+	compressed, compressedHash, err := load().RenderCanonicalCompressed()
+	require.NoError(t, err)
+	assert.Equal(t, hash, compressedHash)
+
+	gz, err := gzip.NewReader(bytes.NewReader(compressed))
+	require.NoError(t, err)
+	decompressed, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, string(b), string(decompressed))
+}
+
+func TestHelmChartInflationGeneratorWithHelmVersionRegex(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	// The default expression would find v2024.1 first.
+	writeFakeHelmVersion(t, th, "acme-helm v2024.1 (helm 3.14.2)", `
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+EOT
+`)
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+helmVersionRegex: helm (?P<version>\d+\.\d+\.\d+)
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+`)
+}
+
+func TestHelmChartInflationGeneratorWithConditionsFile(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+	th.WriteF(filepath.Join(th.GetRoot(), "conditions.yaml"), `
+redis.enabled: false
+metrics.exporter.enabled: true
+`)
+
+	// Render the values helm is given.
+	writeFakeHelm(t, th, `
+while [ $# -gt 0 ]; do
+  if [ "$1" = "-f" ]; then values="$2"; fi
+  shift
+done
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: values
+data:
+  values.yaml: |
+EOT
+sed 's/^/    /' "$values"
+`)
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+conditionsFile: conditions.yaml
+valuesInline:
+  redis:
+    enabled: true
+    replicas: 2
+`)
+
+	values, err := rm.Resources()[0].GetFieldValue("data.values\\.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, `foo: bar
+metrics:
+  exporter:
+    enabled: true
+redis:
+  enabled: false
+  replicas: 2
+`, values)
+}
+
+func TestHelmChartInflationGeneratorWithOrderHooksByWeight(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: notify
+  annotations:
+    helm.sh/hook: post-install,post-upgrade
+    helm.sh/hook-weight: "5"
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate
+  annotations:
+    helm.sh/hook: pre-install,pre-upgrade
+    helm.sh/hook-weight: "10"
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: smoke-test
+  annotations:
+    helm.sh/hook: post-install
+    helm.sh/hook-weight: "-5"
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: db-credentials
+  annotations:
+    helm.sh/hook: pre-install
+    helm.sh/hook-weight: "-1"
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+EOT
+`)
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+orderHooksByWeight: true
+`)
+
+	names := make([]string, 0, rm.Size())
+	for _, r := range rm.Resources() {
+		names = append(names, r.GetName())
+	}
+	assert.Equal(t, []string{
+		"db-credentials", "migrate", "app", "app", "smoke-test", "notify",
+	}, names)
+	assert.Equal(t, "ConfigMap", rm.Resources()[2].GetKind())
+}
+
+func TestHelmChartInflationGeneratorWithDropHooksWithDeletePolicy(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate
+  annotations:
+    helm.sh/hook: pre-install,pre-upgrade
+    helm.sh/hook-delete-policy: before-hook-creation,hook-succeeded
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: backup
+  annotations:
+    helm.sh/hook: pre-upgrade
+    helm.sh/hook-delete-policy: hook-failed
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+  annotations:
+    helm.sh/hook-delete-policy: hook-succeeded
+EOT
+`)
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+dropHooksWithDeletePolicy:
+- hook-succeeded
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  annotations:
+    helm.sh/hook: pre-upgrade
+    helm.sh/hook-delete-policy: hook-failed
+  name: backup
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  annotations:
+    helm.sh/hook-delete-policy: hook-succeeded
+  name: app
+`)
+
+	err := th.ErrorFromLoadGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+dropHooksWithDeletePolicy:
+- succeeded
+`)
+	require.ErrorContains(t, err,
+		"dropHooksWithDeletePolicy must be one of [before-hook-creation hook-succeeded hook-failed]")
+}
+
+func TestHelmChartInflationGeneratorWithDefaultValuesFileName(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+	th.WriteF(filepath.Join(th.GetRoot(), "charts", "test-chart", "values.base.yaml"), "foo: base\n")
+
+	// Render the values helm is given.
+	writeFakeHelm(t, th, `
+while [ $# -gt 0 ]; do
+  if [ "$1" = "-f" ]; then values="$2"; fi
+  shift
+done
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: values
+data:
+  values.yaml: |
+EOT
+sed 's/^/    /' "$values"
+`)
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+defaultValuesFileName: values.base.yaml
+`)
+
+	values, err := rm.Resources()[0].GetFieldValue("data.values\\.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, "foo: base\n", values)
+}
+
+func TestHelmChartInflationGeneratorWithCaptureTiming(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	writeFakeHelm(t, th, `
+sleep 0.2
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+EOT
+`)
+	timings := func(debug bool) []types.HelmPhaseTiming {
+		t.Helper()
+		g := th.LoadGenerator(fmt.Sprintf(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+debug: %t
+captureTiming: true
+`, debug))
+		timer, ok := g.(interface {
+			Timings() []types.HelmPhaseTiming
+		})
+		require.True(t, ok)
+		_, err := g.Generate()
+		require.NoError(t, err)
+		return timer.Timings()
+	}
+
+	captured := timings(true)
+	phases := make([]string, 0, len(captured))
+	for _, timing := range captured {
+		phases = append(phases, timing.Phase)
+	}
+	assert.Equal(t, []string{
+		"version", "pull", "values", "template", "parse", "postprocess",
+	}, phases)
+	assert.GreaterOrEqual(t, captured[3].Duration, 200*time.Millisecond)
+
+	assert.Empty(t, timings(false))
+}
+
+func TestHelmChartInflationGeneratorWithOverlayChart(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	writeFakeHelm(t, th, `
+case "$3" in
+*/patches)
+  cat <<EOT
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: test
+  labels:
+    team: platform
+spec:
+  replicas: 3
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: test-extra
+EOT
+  ;;
+*)
+  cat <<EOT
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: test
+spec:
+  replicas: 1
+  template:
+    spec:
+      containers:
+      - name: app
+        image: app:1.0
+EOT
+  ;;
+esac
+`)
+	rm := th.LoadAndRunGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+overlayChart: patches
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    team: platform
+  name: test
+spec:
+  replicas: 3
+  template:
+    spec:
+      containers:
+      - image: app:1.0
+        name: app
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: test-extra
+`)
+}
+
+func TestHelmChartInflationGeneratorWithCredentialsSecret(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+
+	pull := filepath.Join(t.TempDir(), "pull")
+	writeFakeHelm(t, th, fmt.Sprintf(`
+if [ "$1" = "pull" ]; then
+  echo "$@" > %[1]s
+  cat "$HELM_REGISTRY_CONFIG" >> %[1]s
+  exit 1
+fi
+`, pull))
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: podinfo
+name: podinfo
+version: 6.2.1
+repo: oci://ghcr.io/stefanprodan/charts
+releaseName: podinfo
+credentialsSecret: secret.yaml
+`
+
+	th.WriteF(filepath.Join(th.GetRoot(), "secret.yaml"), `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: repo-credentials
+data:
+  username: YWxpY2U=
+  password: czNjcjN0
+`)
+	// The credentials are in the registry config, not the args.
+	_, err := th.LoadGenerator(config).Generate()
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "s3cr3t")
+	b, err := os.ReadFile(pull)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("pull --untar --untardir %s "+
+		"oci://ghcr.io/stefanprodan/charts/podinfo --version 6.2.1\n"+
+		`{"auths":{"ghcr.io":{"auth":"YWxpY2U6czNjcjN0"}}}`,
+		filepath.Join(th.GetRoot(), "charts", "podinfo-6.2.1")), string(b))
+
+	th.WriteF(filepath.Join(th.GetRoot(), "secret.yaml"), `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: repo-credentials
+data:
+  username: YWxpY2U=
+  password: not base64!
+`)
+	err = th.ErrorFromLoadGenerator(config)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(),
+		"could not decode 'password' of credentialsSecret 'secret.yaml'")
+}
+
+func TestHelmChartInflationGeneratorWithPostRenderTransforms(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+EOT
+`)
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+`
+	type transformable interface {
+		SetPostRenderTransforms(...func([]*yaml.RNode) ([]*yaml.RNode, error))
+	}
+	annotate := func(nodes []*yaml.RNode) ([]*yaml.RNode, error) {
+		for _, node := range nodes {
+			if err := node.PipeE(yaml.SetAnnotation("team", "platform")); err != nil {
+				return nil, err
+			}
+		}
+		return nodes, nil
+	}
+
+	g := th.LoadGenerator(config)
+	transformer, ok := g.(transformable)
+	require.True(t, ok)
+	transformer.SetPostRenderTransforms(annotate)
+	rm, err := g.Generate()
+	require.NoError(t, err)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  annotations:
+    team: platform
+  name: foo
+`)
+
+	g = th.LoadGenerator(config)
+	transformer, ok = g.(transformable)
+	require.True(t, ok)
+	transformer.SetPostRenderTransforms(annotate,
+		func([]*yaml.RNode) ([]*yaml.RNode, error) {
+			return nil, fmt.Errorf("boom")
+		})
+	_, err = g.Generate()
+	require.EqualError(t, err, "post-render transform 1: boom")
+}
+
+func TestHelmChartInflationGeneratorWithSetJSONValues(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	// Render the --set-json flags helm is given.
+	body := `
+while [ $# -gt 0 ]; do
+  if [ "$1" = "--set-json" ]; then value="$2"; fi
+  shift
+done
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: values
+data:
+  setJSON: '$value'
+EOT
+`
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+setJSONValues:
+  tolerations: %s
+`
+
+	writeFakeHelm(t, th, body)
+	rm := th.LoadAndRunGenerator(fmt.Sprintf(config, `'[{"key":"gpu","operator":"Exists"}]'`))
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+data:
+  setJSON: tolerations=[{"key":"gpu","operator":"Exists"}]
+kind: ConfigMap
+metadata:
+  name: values
+`)
+
+	err := th.ErrorFromLoadGenerator(fmt.Sprintf(config, `'[{"key":'`))
+	require.ErrorContains(t, err,
+		`setJSONValues 'tolerations' is not valid JSON: [{"key":`)
+
+	writeFakeHelmVersion(t, th, "v3.9.4+g9dd5a8b", body)
+	_, err = th.LoadGenerator(fmt.Sprintf(config, `'[]'`)).Generate()
+	require.EqualError(t, err,
+		"setJSONValues requires helm v3.10.0 or later but got v3.9.4")
+}
+
+func TestHelmChartInflationGeneratorWithImageDenylist(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      initContainers:
+      - name: init
+        image: busybox
+      containers:
+      - name: web
+        image: index.docker.io/library/nginx:1.19.2
+      - name: sidecar
+        image: registry.example.com/proxy:2.0
+EOT
+`)
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+imageDenylist:
+- %s
+`
+	for _, tc := range []struct {
+		pattern string
+		denied  string
+	}{
+		{pattern: "nginx:1.19.*", denied: "index.docker.io/library/nginx:1.19.2"},
+		{pattern: "busybox:latest", denied: "busybox"},
+		{pattern: "registry.example.com/*:2.0", denied: "registry.example.com/proxy:2.0"},
+		{pattern: "nginx:1.2*"},
+	} {
+		t.Run(tc.pattern, func(t *testing.T) {
+			_, err := th.LoadGenerator(fmt.Sprintf(config, tc.pattern)).Generate()
+			if tc.denied == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, fmt.Sprintf(
+				"helm chart 'test-chart' uses images denied by imageDenylist:\n"+
+					"- Deployment.v1.apps/web.[noNs]: image '%s' matches '%s'",
+				tc.denied, tc.pattern))
+		})
+	}
+
+	require.ErrorContains(t, th.ErrorFromLoadGenerator(fmt.Sprintf(config, "'nginx:[1'")),
+		"invalid imageDenylist pattern 'nginx:[1'")
+}
+
+func TestHelmChartInflationGeneratorWithRequireImageDigests(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	const digest = "sha256:0d17b565c37bcbd895e9d92315a05c1c3c9a29f762b011a10c54a66cd53c9b31"
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+requireImageDigests: true
+`
+	deployment := `
+cat <<EOT
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      initContainers:
+      - name: init
+        image: %s
+      containers:
+      - name: web
+        image: %s
+EOT
+`
+
+	writeFakeHelm(t, th, fmt.Sprintf(deployment, "busybox", "nginx:1.25"))
+	_, err := th.LoadGenerator(config).Generate()
+	require.EqualError(t, err,
+		"helm chart 'test-chart' uses images by tag, not digest, despite requireImageDigests:\n"+
+			"- Deployment.v1.apps/web.[noNs]: image 'busybox' has no digest\n"+
+			"- Deployment.v1.apps/web.[noNs]: image 'nginx:1.25' has no digest")
+
+	writeFakeHelm(t, th, fmt.Sprintf(deployment,
+		"busybox@"+digest, "registry.example.com/web:1.0@"+digest))
+	_, err = th.LoadGenerator(config).Generate()
+	require.NoError(t, err)
+}
+
+func TestHelmChartInflationGeneratorWithRequireChartApiVersion(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+	th.WriteF(filepath.Join(th.MkDir("charts/legacy-chart"), "Chart.yaml"), `
+apiVersion: v1
+name: legacy-chart
+version: 0.1.0
+`)
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+EOT
+`)
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: %[1]s
+name: %[1]s
+releaseName: test
+chartHome: ./charts
+valuesFile: ./charts/test-chart/values.yaml
+requireChartApiVersion: v2
+`
+	_, err := th.LoadGenerator(fmt.Sprintf(config, "test-chart")).Generate()
+	require.NoError(t, err)
+
+	_, err = th.LoadGenerator(fmt.Sprintf(config, "legacy-chart")).Generate()
+	require.EqualError(t, err,
+		"helm chart 'legacy-chart' has apiVersion 'v1' but requireChartApiVersion is 'v2'")
+}
+
+func TestHelmChartInflationGeneratorWithBuiltinOverrides(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	chartDir := th.MkDir("charts")
+	th.MkDir("charts/named-chart")
+	th.WriteF(filepath.Join(chartDir, "named-chart", "Chart.yaml"), `
+apiVersion: v2
+name: named-chart
+version: 0.1.0
+`)
+	th.WriteF(filepath.Join(chartDir, "named-chart", "values.yaml"), "")
+	th.WriteF(filepath.Join(th.MkDir("charts/named-chart/templates"), "configmap.yaml"), `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Chart.Name }}-config
+  labels:
+    app.kubernetes.io/managed-by: {{ .Release.Service }}
+data:
+  service: {{ $.Release.Service | quote }}
+`)
+
+	// Render .Chart.Name from Chart.yaml, and string literals.
+	writeFakeHelm(t, th, `
+name=$(sed -n 's/^name: //p' "$3/Chart.yaml")
+sed -e "s/{{ .Chart.Name }}/$name/" \
+    -e 's/{{ "\([^"]*\)" | quote }}/"\1"/' \
+    -e 's/{{ "\([^"]*\)" }}/\1/' "$3/templates/configmap.yaml"
+`)
+
+	rm := th.LoadAndRunGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: named-chart
+name: named-chart
+releaseName: test
+chartHome: ./charts
+chartNameOverride: renamed
+releaseService: Kustomize
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+data:
+  service: Kustomize
+kind: ConfigMap
+metadata:
+  labels:
+    app.kubernetes.io/managed-by: Kustomize
+  name: renamed-config
+`)
+
+	// The chart itself is left as it was.
+	b, err := os.ReadFile(filepath.Join(chartDir, "named-chart", "Chart.yaml"))
+	require.NoError(t, err)
+	assert.Contains(t, string(b), "name: named-chart")
+}
+
+func TestHelmChartInflationGeneratorWithRequireAppVersion(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+EOT
+`)
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+requireAppVersion: %s
+`
+	_, err := th.LoadGenerator(fmt.Sprintf(config, "stable")).Generate()
+	require.NoError(t, err)
+
+	_, err = th.LoadGenerator(fmt.Sprintf(config, "1.2.3")).Generate()
+	require.EqualError(t, err,
+		"helm chart 'test-chart' has appVersion 'stable' but requireAppVersion is '1.2.3'")
+}
+
+func TestHelmChartInflationGeneratorWithOnlySubchart(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	// Render the templates of an umbrella chart matching --show-only.
+	writeFakeHelm(t, th, `
+while [ $# -gt 0 ]; do
+  if [ "$1" = "--show-only" ]; then showOnly="$2"; fi
+  shift
+done
+case "charts/db/templates/statefulset.yaml" in
+$showOnly)
+  cat <<EOT
+---
+# Source: umbrella/charts/db/templates/statefulset.yaml
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: db
+EOT
+esac
+case "templates/deployment.yaml" in
+$showOnly)
+  cat <<EOT
+---
+# Source: umbrella/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+EOT
+esac
+`)
+	rm := th.LoadAndRunGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+onlySubchart: db
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: db
+`)
+}
+
+func TestHelmChartInflationGeneratorWithKeepTarball(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+
+	archive, err := base64.StdEncoding.DecodeString(chartArchive(t, "test-chart"))
+	require.NoError(t, err)
+	source := filepath.Join(t.TempDir(), "test-chart.tgz")
+	require.NoError(t, os.WriteFile(source, archive, 0644))
+
+	// Pull the archive, and render the chart helm is given.
+	pullArgs := filepath.Join(t.TempDir(), "pull-args")
+	writeFakeHelm(t, th, fmt.Sprintf(`
+if [ "$1" = "pull" ]; then
+  echo "$@" > %s
+  while [ $# -gt 0 ]; do
+    if [ "$1" = "--destination" ]; then cp %s "$2/test-chart-1.0.0.tgz"; fi
+    shift
+  done
+  exit 0
+fi
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: chart
+data:
+  chart: $3
+EOT
+`, pullArgs, source))
+	rm := th.LoadAndRunGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+version: 1.0.0
+repo: https://charts.example.com
+releaseName: test
+keepTarball: true
+requireChartApiVersion: v2
+`)
+	chart, err := rm.Resources()[0].GetFieldValue("data.chart")
+	require.NoError(t, err)
+	chartHome := filepath.Join(th.GetRoot(), "charts/test-chart-1.0.0")
+	assert.Equal(t, filepath.Join(chartHome, "test-chart-1.0.0.tgz"), chart)
+
+	b, err := os.ReadFile(pullArgs)
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "--untar")
+	entries, err := os.ReadDir(chartHome)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "test-chart-1.0.0.tgz", entries[0].Name())
+}
+
+func TestHelmChartInflationGeneratorWithOnMissingValues(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	th.MkDir("charts")
+	th.WriteF(filepath.Join(th.MkDir("charts/no-values"), "Chart.yaml"), `
+apiVersion: v2
+name: no-values
+version: 1.0.0
+`)
+
+	// Render the values file helm is given, if any.
+	writeFakeHelm(t, th, `
+values=none
+while [ $# -gt 0 ]; do
+  if [ "$1" = "-f" ]; then values="'$(cat "$2")'"; fi
+  shift
+done
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: values
+data:
+  values: $values
+EOT
+`)
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: no-values
+name: no-values
+releaseName: test
+chartHome: ./charts
+onMissingValues: %s
+`
+	for policy, expected := range map[string]string{
+		"ignore": "none",
+		"empty":  "",
+	} {
+		t.Run(policy, func(t *testing.T) {
+			rm := th.LoadAndRunGenerator(fmt.Sprintf(config, policy))
+			values, err := rm.Resources()[0].GetFieldValue("data.values")
+			require.NoError(t, err)
+			assert.Equal(t, expected, values)
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		_, err := th.LoadGenerator(fmt.Sprintf(config, "error")).Generate()
+		require.ErrorContains(t, err, "charts/no-values/values.yaml")
+	})
+
+	require.ErrorContains(t, th.ErrorFromLoadGenerator(fmt.Sprintf(config, "skip")),
+		"onMissingValues must be one of [error ignore empty]")
+}
+
+func TestHelmChartInflationGeneratorWithRemoveFields(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  annotations:
+    helm.sh/resource-policy: keep
+spec:
+  template:
+    metadata:
+      annotations:
+        checksum/config: abc123
+        team: web
+    spec:
+      containers:
+      - name: web
+        image: nginx
+        resources: {}
+status:
+  replicas: 1
+---
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: db
+spec:
+  template:
+    metadata:
+      annotations:
+        checksum/config: def456
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+EOT
+`)
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+removeFields: %s
+`
+	rm := th.LoadAndRunGenerator(fmt.Sprintf(config, `
+- status
+- spec.template.metadata.annotations.checksum/config
+- metadata.annotations.[helm.sh/resource-policy]
+- spec.template.spec.containers.[name=web].resources`))
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  annotations: {}
+  name: web
+spec:
+  template:
+    metadata:
+      annotations:
+        team: web
+    spec:
+      containers:
+      - image: nginx
+        name: web
+---
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: db
+spec:
+  template:
+    metadata:
+      annotations: {}
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+`)
+
+	require.ErrorContains(t, th.ErrorFromLoadGenerator(fmt.Sprintf(config, "[spec.template..metadata]")),
+		"invalid removeFields path 'spec.template..metadata'")
+	require.ErrorContains(t, th.ErrorFromLoadGenerator(fmt.Sprintf(config, `["spec.containers.[name=web]"]`)),
+		"invalid removeFields path 'spec.containers.[name=web]'")
+}
+
+func TestHelmChartInflationGeneratorWithRenderCacheDir(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	renders := filepath.Join(t.TempDir(), "renders")
+	writeFakeHelm(t, th, fmt.Sprintf(`
+echo "$1" >> %s
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+EOT
+`, renders))
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: %s
+chartHome: ./charts
+renderCacheDir: %s
+`
+	cacheDir := t.TempDir()
+	expected := `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+`
+	countRenders := func() int {
+		t.Helper()
+		b, err := os.ReadFile(renders)
+		require.NoError(t, err)
+		return strings.Count(string(b), "template\n")
+	}
+
+	th.AssertActualEqualsExpected(
+		th.LoadAndRunGenerator(fmt.Sprintf(config, "test", cacheDir)), expected)
+	assert.Equal(t, 1, countRenders())
+
+	// Nothing changed, so helm template isn't run again.
+	th.AssertActualEqualsExpected(
+		th.LoadAndRunGenerator(fmt.Sprintf(config, "test", cacheDir)), expected)
+	assert.Equal(t, 1, countRenders())
+
+	// Changing the config, the values or the chart misses the cache.
+	th.LoadAndRunGenerator(fmt.Sprintf(config, "other", cacheDir))
+	assert.Equal(t, 2, countRenders())
+	valuesFile := filepath.Join(th.GetRoot(), "charts/test-chart/values.yaml")
+	values, err := os.ReadFile(valuesFile)
+	require.NoError(t, err)
+	th.WriteF(valuesFile, string(values)+"\nextra: true\n")
+	th.LoadAndRunGenerator(fmt.Sprintf(config, "test", cacheDir))
+	assert.Equal(t, 3, countRenders())
+	th.WriteF(filepath.Join(th.GetRoot(), "charts/test-chart/templates/extra.yaml"), "")
+	th.LoadAndRunGenerator(fmt.Sprintf(config, "test", cacheDir))
+	assert.Equal(t, 4, countRenders())
+	th.LoadAndRunGenerator(fmt.Sprintf(config, "test", cacheDir))
+	assert.Equal(t, 4, countRenders())
+}
+
+func TestHelmChartInflationGeneratorWithTargetNamespace(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	// Render the namespace helm is given into the resources.
+	writeFakeHelm(t, th, `
+while [ $# -gt 0 ]; do
+  if [ "$1" = "--namespace" ]; then namespace="$2"; fi
+  shift
+done
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+  namespace: $namespace
+data:
+  releaseNamespace: $namespace
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: foo
+EOT
+`)
+	rm := th.LoadAndRunGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+namespace: chart-ns
+targetNamespace: placed-ns
+createNamespace: true
+`)
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: placed-ns
+---
+apiVersion: v1
+data:
+  releaseNamespace: chart-ns
+kind: ConfigMap
+metadata:
+  name: foo
+  namespace: placed-ns
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: foo
+`)
+}
+
+func TestHelmChartInflationGeneratorResolvedVersion(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+
+	// Pull whatever version of the chart the registry has.
+	writeFakeHelm(t, th, `
+if [ "$1" = "pull" ]; then
+  while [ $# -gt 0 ]; do
+    if [ "$1" = "--untardir" ]; then
+      mkdir -p "$2/podinfo"
+      touch "$2/podinfo/values.yaml"
+      printf 'apiVersion: v2\nname: podinfo\nversion: 6.7.1\n' > "$2/podinfo/Chart.yaml"
+    fi
+    shift
+  done
+  exit 0
+fi
+`)
+	for i, tc := range []struct {
+		version  string
+		expected string
+	}{
+		{version: "latest", expected: "6.7.1"},
+		{version: "", expected: "6.7.1"},
+		{version: "6.2.1", expected: "6.2.1"},
+	} {
+		t.Run("version '"+tc.version+"'", func(t *testing.T) {
+			g := th.LoadGenerator(fmt.Sprintf(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: podinfo
+name: podinfo
+version: %q
+repo: oci://ghcr.io/stefanprodan/charts
+releaseName: podinfo
+chartHome: ./charts-%d
+`, tc.version, i))
+			resolver, ok := g.(interface{ ResolvedVersion() string })
+			require.True(t, ok)
+			_, err := g.Generate()
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, resolver.ResolvedVersion())
+		})
+	}
+}
+
+func TestHelmChartInflationGeneratorWithHeaders(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+
+	pull := filepath.Join(t.TempDir(), "pull")
+	writeFakeHelm(t, th, fmt.Sprintf(`
+if [ "$1" = "repo" ]; then
+  echo "$@" > %[1]s
+  cat "$HELM_REPOSITORY_CONFIG" >> %[1]s
+fi
+if [ "$1" = "pull" ]; then
+  echo "$@" >> %[1]s
+  if [ -n "$HELM_REGISTRY_CONFIG" ]; then cat "$HELM_REGISTRY_CONFIG" >> %[1]s; fi
+  exit 1
+fi
+`, pull))
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: podinfo
+name: podinfo
+version: 6.2.1
+repo: %s
+releaseName: podinfo
+headers:
+  %s
+`
+	for _, tc := range []struct {
+		name    string
+		repo    string
+		header  string
+		pulled  string
+		invalid string
+	}{
+		{
+			name:   "bearer token for oci",
+			repo:   "oci://ghcr.io/stefanprodan/charts",
+			header: "Authorization: Bearer abc123",
+			pulled: `{"auths":{"ghcr.io":{"registrytoken":"abc123"}}}`,
+		},
+		{
+			name:   "basic credentials",
+			repo:   "https://charts.example.com",
+			header: "authorization: Basic YWxpY2U6czNjcjN0",
+			pulled: `repo update kustomize-credentials
+apiVersion: ""
+repositories:
+- name: kustomize-credentials
+  password: s3cr3t
+  url: https://charts.example.com
+  username: alice
+pull --untar --untardir ` + filepath.Join(th.GetRoot(), "charts", "podinfo-6.2.1") +
+				` kustomize-credentials/podinfo --version 6.2.1`,
+		},
+		{
+			name:    "bearer token for http",
+			repo:    "https://charts.example.com",
+			header:  "Authorization: Bearer abc123",
+			invalid: "a bearer Authorization header requires an oci repo",
+		},
+		{
+			name:    "other header",
+			repo:    "https://charts.example.com",
+			header:  "X-Gateway-Key: abc123",
+			invalid: "header 'X-Gateway-Key' is not supported by helm; only Authorization is",
+		},
+		{
+			name:    "user agent",
+			repo:    "https://charts.example.com",
+			header:  "User-Agent: deployer/1.0",
+			invalid: "helm always sends its own User-Agent",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.invalid != "" {
+				require.ErrorContains(t, th.ErrorFromLoadGenerator(
+					fmt.Sprintf(config, tc.repo, tc.header)), tc.invalid)
+				return
+			}
+			_, err := th.LoadGenerator(fmt.Sprintf(config, tc.repo, tc.header)).Generate()
+			require.Error(t, err)
+			b, err := os.ReadFile(pull)
+			require.NoError(t, err)
+			assert.Contains(t, string(b), tc.pulled)
+		})
+	}
+}
+
+func TestHelmChartInflationGeneratorWithRequireNamespace(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: placed
+  namespace: apps
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: unplaced
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: cluster-wide
+EOT
+`)
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+requireNamespace: true
+%s
+`
+	_, err := th.LoadGenerator(fmt.Sprintf(config, "")).Generate()
+	require.EqualError(t, err,
+		"helm chart 'test-chart' produces namespaced resources without a namespace:\n"+
+			"- Service.v1.[noGrp]/unplaced.[noNs]")
+
+	_, err = th.LoadGenerator(fmt.Sprintf(config, "targetNamespace: apps")).Generate()
+	require.NoError(t, err)
+}
+
+func TestHelmChartInflationGeneratorMergedValuesFileIsStable(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	// Keep a copy of the values file helm is given.
+	dir := t.TempDir()
+	writeFakeHelm(t, th, fmt.Sprintf(`
+while [ $# -gt 0 ]; do
+  if [ "$1" = "-f" ]; then cp "$2" %s/values-$(ls %s | wc -l).yaml; fi
+  shift
+done
+`, dir, dir))
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+valuesMerge: merge
+valuesInline:
+  zeta: 1
+  alpha:
+    nested: {c: 3, a: 1, b: 2}
+  mid: [x, y]
+  beta: true
+`
+	for range 2 {
+		th.LoadAndRunGenerator(config)
+	}
+	first, err := os.ReadFile(filepath.Join(dir, "values-0.yaml"))
+	require.NoError(t, err)
+	second, err := os.ReadFile(filepath.Join(dir, "values-1.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, string(first), string(second))
+}
+
+func TestHelmChartInflationGeneratorWithDeprecations(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+	th.WriteF(filepath.Join(th.GetRoot(), "charts/test-chart/values.deprecations.yaml"), `
+- legacy.enabled
+`)
+
+	writeFakeHelm(t, th, "")
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+deprecations:
+- ingress.className
+valuesInline:
+  ingress:
+    className: nginx
+  legacy:
+    enabled: true
+  replicas: 2
+`
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	th.LoadAndRunGenerator(config)
+	assert.Contains(t, logs.String(),
+		"warning: helm chart 'test-chart' is given deprecated values: ingress.className, legacy.enabled")
+
+	_, err := th.LoadGenerator(config + "deprecationPolicy: error\n").Generate()
+	require.EqualError(t, err,
+		"helm chart 'test-chart' is given deprecated values: ingress.className, legacy.enabled")
+}
+
+func TestHelmChartInflationGeneratorWithExplicitDocumentStart(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	// Separate and end documents inconsistently.
+	writeFakeHelm(t, th, `
+printf -- '---\n\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n\n\n---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: b'
+`)
+	g := th.LoadGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+explicitDocumentStart: true
+`)
+	renderer, ok := g.(interface {
+		RenderCanonical() ([]byte, string, error)
+	})
+	require.True(t, ok)
+	b, _, err := renderer.RenderCanonical()
+	require.NoError(t, err)
+	assert.Equal(t, `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b
+`, string(b))
+}
+
+func TestHelmChartInflationGeneratorWithHelmOpTimeout(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	// Render the timeout helm is given.
+	writeFakeHelm(t, th, `
+while [ $# -gt 0 ]; do
+  if [ "$1" = "--timeout" ]; then timeout="$2"; fi
+  shift
+done
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: timeout
+data:
+  timeout: $timeout
+EOT
+`)
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+helmOpTimeout: %s
+`
+	rm := th.LoadAndRunGenerator(fmt.Sprintf(config, "90s"))
+	timeout, err := rm.Resources()[0].GetFieldValue("data.timeout")
+	require.NoError(t, err)
+	assert.Equal(t, "90s", timeout)
+
+	require.ErrorContains(t, th.ErrorFromLoadGenerator(fmt.Sprintf(config, "soon")),
+		"invalid helmOpTimeout")
+}
+
+func TestHelmChartInflationGeneratorRenderToDir(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  namespace: apps
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: apps
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: web
+EOT
+`)
+	type renderer interface {
+		RenderToDir(dir string) error
+	}
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+`
+	g, ok := th.LoadGenerator(config).(renderer)
+	require.True(t, ok)
+	out := th.MkDir("out")
+	require.NoError(t, g.RenderToDir("out"))
+
+	entries, err := os.ReadDir(out)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{
+		"apps-deployment-web.yaml",
+		"apps-service-web.yaml",
+		"clusterrole-web.yaml",
+	}, names)
+	b, err := os.ReadFile(filepath.Join(out, "apps-service-web.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: apps
+`, string(b))
+
+	g, ok = th.LoadGenerator(config).(renderer)
+	require.True(t, ok)
+	require.ErrorContains(t, g.RenderToDir(t.TempDir()), "which is not in or below")
+}
+
+func TestHelmChartInflationGeneratorRenderToStream(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+EOT
+`)
+	g, ok := th.LoadGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+nameSuffix: -v1
+`).(interface {
+		RenderToStream(w io.Writer) error
+	})
+	require.True(t, ok)
+	var out bytes.Buffer
+	require.NoError(t, g.RenderToStream(&out))
+	assert.Equal(t, `apiVersion: v1
+kind: Service
+metadata:
+  name: web-v1
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web-v1
+`, out.String())
+}
+
+func TestHelmChartInflationGeneratorEmitKustomization(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+EOT
+`)
+	g, ok := th.LoadGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+emitKustomization: true
+`).(interface {
+		RenderToDir(dir string) error
+	})
+	require.True(t, ok)
+	out := th.MkDir("out")
+	require.NoError(t, g.RenderToDir("out"))
+
+	b, err := os.ReadFile(filepath.Join(out, "kustomization.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+resources:
+- deployment-web.yaml
+- service-web.yaml
+`, string(b))
+}
+
+func TestHelmChartInflationGeneratorWithDecryptCommand(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	th.MkDir("charts")
+	th.WriteF(filepath.Join(th.MkDir("charts/secret"), "Chart.yaml"), `
+apiVersion: v2
+name: secret
+version: 1.0.0
+`)
+	th.WriteF(filepath.Join(th.GetRoot(), "values.enc.yaml"), `ENC[password: hunter2]
+`)
+
+	// Render the values file helm is given, its lines folded into one.
+	writeFakeHelm(t, th, `
+while [ $# -gt 0 ]; do
+  if [ "$1" = "-f" ]; then values="$(cat "$2")"; fi
+  shift
+done
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: values
+data:
+  values: '$values'
+EOT
+`)
+	writeDecrypt := func(body string) string {
+		path := filepath.Join(t.TempDir(), "decrypt")
+		require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0700))
+		return path
+	}
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: secret
+name: secret
+releaseName: test
+chartHome: ./charts
+valuesFile: values.enc.yaml
+decryptCommand: %s
+valuesInline:
+  replicas: 2
+valuesMerge: %s
+`
+
+	for merge, expected := range map[string]string{
+		"override": "password: hunter2 replicas: 2",
+		"replace":  "replicas: 2",
+	} {
+		t.Run(merge, func(t *testing.T) {
+			rm := th.LoadAndRunGenerator(fmt.Sprintf(config,
+				writeDecrypt(`sed -e 's/^ENC\[\(.*\)\]$/\1/'`), merge))
+			values, err := rm.Resources()[0].GetFieldValue("data.values")
+			require.NoError(t, err)
+			assert.Equal(t, expected, values)
+		})
+	}
+
+	t.Run("failure", func(t *testing.T) {
+		_, err := th.LoadGenerator(fmt.Sprintf(config,
+			writeDecrypt("echo 'no key to decrypt with' >&2\nexit 1\n"), "override")).Generate()
+		require.ErrorContains(t, err, "unable to decrypt 'values.enc.yaml'")
+		require.ErrorContains(t, err, "no key to decrypt with")
+	})
+
+	t.Run("hang", func(t *testing.T) {
+		_, err := th.LoadGenerator(fmt.Sprintf(config,
+			writeDecrypt("sleep 30\n"), "override") + "decryptTimeout: 100ms\n").Generate()
+		require.ErrorContains(t, err, "unable to decrypt 'values.enc.yaml'")
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	require.ErrorContains(t, th.ErrorFromLoadGenerator(fmt.Sprintf(config,
+		"decrypt", "override")+"decryptTimeout: soon\n"), "invalid decryptTimeout")
+}
+
+func TestHelmChartInflationGeneratorKeepTmpOnError(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	th.MkDir("charts")
+	th.WriteF(filepath.Join(th.MkDir("charts/test-chart"), "Chart.yaml"), `
+apiVersion: v2
+name: test-chart
+version: 1.0.0
+`)
+	th.WriteF(filepath.Join(th.GetRoot(), "charts/test-chart/values.yaml"), "")
+
+	// Record the config home helm is given, which is in the tmp dir,
+	// and fail if told to.
+	home := filepath.Join(t.TempDir(), "home")
+	writeFakeHelm(t, th, fmt.Sprintf(`
+echo "$HELM_CONFIG_HOME" > %s
+for arg in "$@"; do
+  if [ "$arg" = "fail" ]; then echo 'Error: told to' >&2; exit 1; fi
+done
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: test
+EOT
+`, home))
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: %s
+chartHome: ./charts
+keepTmpOnError: true
+`
+	tmpDir := func() string {
+		b, err := os.ReadFile(home)
+		require.NoError(t, err)
+		return filepath.Dir(strings.TrimSpace(string(b)))
+	}
+
+	th.LoadAndRunGenerator(fmt.Sprintf(config, "test"))
+	assert.NoDirExists(t, tmpDir())
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	_, err := th.LoadGenerator(fmt.Sprintf(config, "fail")).Generate()
+	require.ErrorContains(t, err, "told to")
+	kept := tmpDir()
+	defer os.RemoveAll(kept)
+	assert.DirExists(t, kept)
+	assert.FileExists(t, filepath.Join(kept, "test-chart-kustomize-values.yaml"))
+	assert.Contains(t, logs.String(),
+		fmt.Sprintf("keeping tmp dir '%s' of helm chart 'test-chart' for inspection", kept))
+}
+
+func TestHelmChartInflationGeneratorWithReleaseNameTemplate(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	th.MkDir("charts")
+	th.WriteF(filepath.Join(th.MkDir("charts/test-chart"), "Chart.yaml"), `
+apiVersion: v2
+name: test-chart
+version: 1.0.0
+`)
+	th.WriteF(filepath.Join(th.GetRoot(), "charts/test-chart/values.yaml"), "")
+
+	// Name a ConfigMap after the release.
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: $2
+EOT
+`)
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+chartHome: ./charts
+releaseNameData:
+  app: web
+  blank: ""
+`
+	t.Setenv("KUSTOMIZE_HELM_TEST_ENV", "staging")
+	rm := th.LoadAndRunGenerator(config +
+		"releaseNameTemplate: '{{ .Env.KUSTOMIZE_HELM_TEST_ENV }}-{{ .Data.app }}'\n")
+	assert.Equal(t, "staging-web", rm.Resources()[0].GetName())
+
+	for name, tc := range map[string]struct {
+		config string
+		err    string
+	}{
+		"empty": {
+			config: "releaseNameTemplate: '{{ .Data.blank }}'\n",
+			err:    "releaseNameTemplate '{{ .Data.blank }}' renders an empty release name",
+		},
+		"missing key": {
+			config: "releaseNameTemplate: '{{ .Data.env }}-web'\n",
+			err:    `map has no entry for key "env"`,
+		},
+		"unparsable": {
+			config: "releaseNameTemplate: '{{ .Data.app'\n",
+			err:    "invalid releaseNameTemplate",
+		},
+		"with releaseName": {
+			config: "releaseName: web\nreleaseNameTemplate: '{{ .Data.app }}'\n",
+			err:    "releaseName and releaseNameTemplate cannot both be set",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.ErrorContains(t, th.ErrorFromLoadGenerator(config+tc.config), tc.err)
+		})
+	}
+}
+
+func TestHelmChartInflationGeneratorForbidInlineSecrets(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	th.MkDir("charts")
+	th.WriteF(filepath.Join(th.MkDir("charts/test-chart"), "Chart.yaml"), `
+apiVersion: v2
+name: test-chart
+version: 1.0.0
+`)
+	th.WriteF(filepath.Join(th.GetRoot(), "charts/test-chart/values.yaml"), "")
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: test
+EOT
+`)
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+forbidInlineSecrets: true
+valuesInline:
+  auth:
+    password: hunter2
+    existingSecret: ""
+  tokenTTL: 3600
+  webhooks:
+  - url: https://example.com
+    apiKey: abc123
+  refreshToken: ""
+`
+	_, err := th.LoadGenerator(config).Generate()
+	require.EqualError(t, err,
+		"helm chart 'test-chart' is given what look like secrets inline: "+
+			"auth.password, webhooks[0].apiKey; give them to the chart some other way")
+
+	_, err = th.LoadGenerator(config + "secretKeyPatterns: ['^url$']\n").Generate()
+	require.EqualError(t, err,
+		"helm chart 'test-chart' is given what look like secrets inline: "+
+			"webhooks[0].url; give them to the chart some other way")
+
+	require.ErrorContains(t,
+		th.ErrorFromLoadGenerator(config+"secretKeyPatterns: ['(']\n"),
+		"invalid secretKeyPatterns pattern '('")
+}
+
+func TestHelmChartInflationGeneratorPreparesValuesWhilePulling(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	th.WriteF(filepath.Join(th.GetRoot(), "values.yaml"), "replicas: 3\n")
+
+	// Version 1.0.0 of the chart isn't pulled until the values file
+	// helm is to be given shows up in the tmp dir, next to the config
+	// home; version 2.0.0 fails to pull.
+	writeFakeHelm(t, th, `
+if [ "$1" = "pull" ]; then
+  case "$*" in *2.0.0*) echo 'Error: chart not found' >&2; exit 1;; esac
+  values="$(dirname "$HELM_CONFIG_HOME")/test-chart-kustomize-values.yaml"
+  case "$*" in *1.0.0*)
+    for i in $(seq 50); do
+      if [ -f "$values" ]; then break; fi
+      sleep 0.1
+    done
+    if [ ! -f "$values" ]; then echo 'Error: values not prepared' >&2; exit 1; fi
+  esac
+  while [ $# -gt 0 ]; do
+    if [ "$1" = "--untardir" ]; then
+      mkdir -p "$2/test-chart"
+      printf 'apiVersion: v2\nname: test-chart\nversion: 1.0.0\n' > "$2/test-chart/Chart.yaml"
+    fi
+    shift
+  done
+  exit 0
+fi
+while [ $# -gt 0 ]; do
+  if [ "$1" = "-f" ]; then values="$(cat "$2")"; fi
+  shift
+done
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: values
+data:
+  values: '$values'
+EOT
+`)
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+version: %s
+repo: https://charts.example.com
+releaseName: test
+chartHome: ./charts-%d
+valuesFile: %s
+`
+
+	rm := th.LoadAndRunGenerator(fmt.Sprintf(config, "1.0.0", 0, "values.yaml"))
+	values, err := rm.Resources()[0].GetFieldValue("data.values")
+	require.NoError(t, err)
+	assert.Equal(t, "replicas: 3", values)
+
+	_, err = th.LoadGenerator(fmt.Sprintf(config, "2.0.0", 1, "values.yaml")).Generate()
+	require.ErrorContains(t, err, "chart not found")
+
+	_, err = th.LoadGenerator(fmt.Sprintf(config, "3.0.0", 2, "missing.yaml")).Generate()
+	require.ErrorContains(t, err, "missing.yaml")
+
+	// Failing both, the pull is reported first, but not alone.
+	_, err = th.LoadGenerator(fmt.Sprintf(config, "2.0.0", 3, "missing.yaml")).Generate()
+	require.ErrorContains(t, err, "chart not found")
+	require.ErrorContains(t, err, "missing.yaml")
+	assert.Less(t, strings.Index(err.Error(), "chart not found"),
+		strings.Index(err.Error(), "missing.yaml"))
+}
+
+func TestHelmChartInflationGeneratorWithSetArgs(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	// Render the --set flag helm is given.
+	writeFakeHelm(t, th, `
+while [ $# -gt 0 ]; do
+  if [ "$1" = "--set" ]; then value="$2"; fi
+  shift
+done
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: values
+data:
+  set: '$value'
+EOT
+`)
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+setArgs: '%s'
+`
+	rm := th.LoadAndRunGenerator(fmt.Sprintf(config,
+		`image.tag=1.2.3,args[0]=--verbose,podAnnotations.example\.com/team=a\,b,hosts={a,b},empty=`))
+	th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+data:
+  set: image.tag=1.2.3,args[0]=--verbose,podAnnotations.example\.com/team=a\,b,hosts={a,b},empty=
+kind: ConfigMap
+metadata:
+  name: values
+`)
+
+	for _, tc := range []struct {
+		setArgs    string
+		assignment string
+	}{
+		{setArgs: "image.tag", assignment: "image.tag"},
+		{setArgs: "a=1,", assignment: ""},
+		{setArgs: "a..b=1", assignment: "a..b=1"},
+		{setArgs: "a[x]=1", assignment: "a[x]=1"},
+		{setArgs: "=1", assignment: "=1"},
+	} {
+		require.ErrorContains(t, th.ErrorFromLoadGenerator(fmt.Sprintf(config, tc.setArgs)),
+			fmt.Sprintf("invalid setArgs assignment '%s'", tc.assignment))
+	}
+}
+
+func TestHelmChartInflationGeneratorKindCounts(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: worker
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: web
+EOT
+`)
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+namespace: apps
+createNamespace: true
+reportOutput: %t
+`
+	g := th.LoadGenerator(fmt.Sprintf(config, false))
+	counter, ok := g.(interface{ KindCounts() map[string]int })
+	require.True(t, ok)
+	_, err := g.Generate()
+	require.NoError(t, err)
+	assert.Nil(t, counter.KindCounts())
+
+	g = th.LoadGenerator(fmt.Sprintf(config, true))
+	counter, ok = g.(interface{ KindCounts() map[string]int })
+	require.True(t, ok)
+	assert.Nil(t, counter.KindCounts())
+	_, err = g.Generate()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{
+		"ConfigMap":  1,
+		"Deployment": 2,
+		"Namespace":  1,
+		"Service":    1,
+	}, counter.KindCounts())
+}
+
+func TestHelmChartInflationGeneratorManifestHash(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+	chartYaml := filepath.Join(th.GetRoot(), "charts", "test-chart", "Chart.yaml")
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: chart
+data:
+  version: "$(sed -n 's/^version: //p' "$3/Chart.yaml")"
+EOT
+`)
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+reportOutput: true
+`
+	hash := func() string {
+		t.Helper()
+		g := th.LoadGenerator(config)
+		_, err := g.Generate()
+		require.NoError(t, err)
+		hasher, ok := g.(interface{ ManifestHash() string })
+		require.True(t, ok)
+		return hasher.ManifestHash()
+	}
+
+	first := hash()
+	assert.Len(t, first, 64)
+	assert.Equal(t, first, hash())
+
+	// The config is the same, but the chart isn't.
+	b, err := os.ReadFile(chartYaml)
+	require.NoError(t, err)
+	th.WriteF(chartYaml, strings.Replace(string(b), "version: 1.0.0", "version: 1.0.1", 1))
+	assert.NotEqual(t, first, hash())
+
+	// It isn't worked out unless asked for.
+	config = strings.Replace(config, "reportOutput: true", "reportOutput: false", 1)
+	assert.Empty(t, hash())
+}
+
+func TestHelmChartInflationGeneratorDiffKubeVersions(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	// Pick the Ingress apiVersion by the kube version, like charts
+	// do with semverCompare, and render the values helm is given.
+	writeFakeHelm(t, th, `
+ingress=networking.k8s.io/v1
+while [ $# -gt 0 ]; do
+  case "$1" in
+    --kube-version) case "$2" in 1.1[0-8].*) ingress=extensions/v1beta1;; esac;;
+    -f) values="$(cat "$2")";;
+  esac
+  shift
+done
+cat <<EOT
+apiVersion: $ingress
+kind: Ingress
+metadata:
+  name: web
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: values
+data:
+  values: '$values'
+EOT
+`)
+	type differ interface {
+		DiffKubeVersions() ([]resmap.ResourceChange, error)
+	}
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+valuesInline:
+  replicas: 2
+`
+	g, ok := th.LoadGenerator(config + `
+compareKubeVersions: [1.18.0, 1.19.0]
+`).(differ)
+	require.True(t, ok)
+	changes, err := g.DiffKubeVersions()
+	require.NoError(t, err)
+	assert.Equal(t, []resmap.ResourceChange{
+		{
+			Id:   resid.NewResId(resid.NewGvk("networking.k8s.io", "v1", "Ingress"), "web"),
+			Type: resmap.ChangeChanged,
+		},
+	}, changes)
+
+	g, ok = th.LoadGenerator(config).(differ)
+	require.True(t, ok)
+	_, err = g.DiffKubeVersions()
+	require.EqualError(t, err, "compareKubeVersions must be specified to diff")
+
+	require.ErrorContains(t, th.ErrorFromLoadGenerator(config+`
+compareKubeVersions: [1.18.0]
+`), "compareKubeVersions must list two versions")
+}
+
+func TestHelmChartInflationGeneratorWithPluginsDir(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	th.MkDir("plugins")
+	th.WriteF(filepath.Join(th.MkDir("plugins/helm-s3"), "plugin.yaml"), `
+name: s3
+version: 0.16.0
+downloaders:
+- command: bin/helm-s3
+  protocols:
+  - s3
+`)
+
+	// Record where helm looks for plugins, and what it finds there.
+	pull := filepath.Join(t.TempDir(), "pull")
+	writeFakeHelm(t, th, fmt.Sprintf(`
+case "$1" in
+  env) echo /home/user/.local/share/helm/plugins;;
+  pull)
+    echo "HELM_PLUGINS=${HELM_PLUGINS#$HELM_DATA_HOME}" > %[1]s
+    grep name: "$HELM_PLUGINS/helm-s3/plugin.yaml" >> %[1]s
+    mkdir -p "$4/mychart" && touch "$4/mychart/values.yaml";;
+esac
+`, pull))
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: mychart
+name: mychart
+version: 1.0.0
+repo: s3://my-bucket/charts
+releaseName: test
+chartHome: ./charts-%d
+pluginsDir: %s
+`
+	g := th.LoadGenerator(fmt.Sprintf(config, 0, "plugins"))
+	_, err := g.Generate()
+	require.NoError(t, err)
+	b, err := os.ReadFile(pull)
+	require.NoError(t, err)
+	assert.Equal(t, "HELM_PLUGINS=/plugins\nname: s3\n", string(b))
+
+	// The links went with the last run's tmp dir; a new pull needs them again.
+	require.NoError(t, os.RemoveAll(filepath.Join(th.GetRoot(), "charts-0")))
+	require.NoError(t, os.Remove(pull))
+	_, err = g.Generate()
+	require.NoError(t, err)
+	b, err = os.ReadFile(pull)
+	require.NoError(t, err)
+	assert.Equal(t, "HELM_PLUGINS=/plugins\nname: s3\n", string(b))
+
+	th.MkDir("plugins/broken")
+	_, err = th.LoadGenerator(fmt.Sprintf(config, 1, "plugins")).Generate()
+	require.ErrorContains(t, err, "could not load helm plugin 'broken'")
+
+	outside := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(outside, "helm-s3"), 0755))
+	require.NoError(t, os.WriteFile(
+		filepath.Join(outside, "helm-s3", "plugin.yaml"), []byte("name: s3\n"), 0644))
+	_, err = th.LoadGenerator(fmt.Sprintf(config, 2, outside)).Generate()
+	require.ErrorContains(t, err, "security; file")
+}
+
+func TestHelmChartInflationGeneratorHelmCommandInPath(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: test
+EOT
+`)
+	// Put the fake helm in PATH as helm3.
+	bin := t.TempDir()
+	require.NoError(t, os.Rename(
+		th.GetPluginConfig().HelmConfig.Command, filepath.Join(bin, "helm3")))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+`
+	th.GetPluginConfig().HelmConfig.Command = "helm3"
+	assert.Len(t, th.LoadAndRunGenerator(config).Resources(), 1)
+
+	// Configuring doesn't need helm, but running it does,
+	// and Preflight reports it missing.
+	th.GetPluginConfig().HelmConfig.Command = "helm3-not-installed"
+	g := th.LoadGenerator(config)
+	_, err := g.Generate()
+	require.ErrorContains(t, err,
+		"helm3-not-installed not found in PATH; install helm, or give the helm command as a path")
+	checker, ok := th.LoadGenerator(config).(interface{ Preflight() error })
+	require.True(t, ok)
+	require.ErrorContains(t, checker.Preflight(),
+		"- helm: helm3-not-installed not found in PATH")
+}
+
+func TestHelmChartInflationGeneratorExplainValues(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	th.MkDir("charts")
+	dir := th.MkDir("charts/test-chart")
+	th.WriteF(filepath.Join(dir, "Chart.yaml"), `
+apiVersion: v2
+name: test-chart
+version: 1.0.0
+`)
+	th.WriteF(filepath.Join(dir, "values.yaml"), `
+replicas: 1
+image:
+  repository: nginx
+  tag: "1.0"
+service:
+  port: 80
+`)
+	th.WriteF(filepath.Join(th.GetRoot(), "prod.yaml"), `
+service:
+  port: 8080
+`)
+	writeFakeHelm(t, th, `
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: test
+EOT
+`)
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+explainValues: true
+additionalValuesFiles:
+- prod.yaml
+valuesInline:
+  image:
+    tag: "2.0"
+  resources: {}
+valuesMerge: %s
+`
+	type explainer interface {
+		ValueSources() []types.HelmValueSource
+	}
+	for merge, tagSource := range map[string]string{
+		"override": "valuesInline",
+		"merge":    "chart defaults",
+	} {
+		t.Run(merge, func(t *testing.T) {
+			g := th.LoadGenerator(fmt.Sprintf(config, merge))
+			e, ok := g.(explainer)
+			require.True(t, ok)
+			_, err := g.Generate()
+			require.NoError(t, err)
+			assert.Equal(t, []types.HelmValueSource{
+				{Path: "image.repository", Source: "chart defaults"},
+				{Path: "image.tag", Source: tagSource},
+				{Path: "replicas", Source: "chart defaults"},
+				{Path: "service.port", Source: "additionalValuesFiles prod.yaml"},
+			}, e.ValueSources())
+		})
+	}
+}
+
+func TestHelmChartInflationGeneratorResolvedValues(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	th.MkDir("charts")
+	dir := th.MkDir("charts/test-chart")
+	th.WriteF(filepath.Join(dir, "Chart.yaml"), `
+apiVersion: v2
+name: test-chart
+version: 1.0.0
+`)
+	th.WriteF(filepath.Join(dir, "values.yaml"), `
+replicas: 1
+image:
+  repository: nginx
+  tag: "1.0"
+service:
+  port: 80
+  annotations:
+    a: b
+`)
+	th.WriteF(filepath.Join(th.GetRoot(), "prod.yaml"), `
+replicas: 3
+service:
+  port: 8080
+`)
+	// Resolving the values mustn't run helm template.
+	writeFakeHelm(t, th, "exit 1\n")
+
+	g, ok := th.LoadGenerator(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+additionalValuesFiles:
+- prod.yaml
+valuesInline:
+  replicas: 2
+  image:
+    tag: "2.0"
+  service:
+    annotations: null
+setJSONValues:
+  service.ports: "[80, 443]"
+`).(interface {
+		ResolvedValues() (map[string]interface{}, error)
+	})
+	require.True(t, ok)
+	values, err := g.ResolvedValues()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"replicas": float64(3),
+		"image": map[string]interface{}{
+			"repository": "nginx",
+			"tag":        "2.0",
+		},
+		"service": map[string]interface{}{
+			"port":  float64(8080),
+			"ports": []interface{}{float64(80), float64(443)},
+		},
+	}, values)
+}
+
+func TestHelmChartInflationGeneratorWithValuesFromConfigMaps(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	th.MkDir("charts")
+	dir := th.MkDir(filepath.Join("charts", "test-chart"))
+	th.WriteF(filepath.Join(dir, "Chart.yaml"), `
+apiVersion: v2
+name: test-chart
+version: 1.0.0
+`)
+	th.WriteF(filepath.Join(dir, "values.yaml"), "replicas: 1\n")
+
+	// Render the values helm is given.
+	writeFakeHelm(t, th, `
+while [ $# -gt 0 ]; do
+  if [ "$1" = "-f" ]; then values="$2"; fi
+  shift
+done
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: values
+data:
+  values.yaml: |
+EOT
+sed 's/^/    /' "$values"
+`)
+	buildResources, err := resmap.NewFactory(
+		provider.NewDefaultDepProvider().GetResourceFactory()).
+		NewResMapFromBytes([]byte(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: chart-values
+data:
+  values.yaml: |
+    image:
+      tag: "2.0"
+`))
+	require.NoError(t, err)
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+valuesInline:
+  replicas: 2
+valuesFromConfigMaps:
+- name: chart-values
+  key: values.yaml
+`
+	type valuesGenerator interface {
+		resmap.Generator
+		SetBuildResources(rm resmap.ResMap)
+		ResolvedValues() (map[string]interface{}, error)
+	}
+
+	g, ok := th.LoadGenerator(config).(valuesGenerator)
+	require.True(t, ok)
+	g.SetBuildResources(buildResources)
+	// Running again mustn't apply the ConfigMap values twice,
+	// nor leave the config changed.
+	for range 2 {
+		rm, err := g.Generate()
+		require.NoError(t, err)
+		rm.RemoveBuildAnnotations()
+		th.AssertActualEqualsExpected(rm, `
+apiVersion: v1
+data:
+  values.yaml: |
+    image:
+      tag: "2.0"
+    replicas: 2
+kind: ConfigMap
+metadata:
+  name: values
+`)
+	}
+
+	g, ok = th.LoadGenerator(config).(valuesGenerator)
+	require.True(t, ok)
+	g.SetBuildResources(buildResources)
+	values, err := g.ResolvedValues()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"replicas": float64(2),
+		"image":    map[string]interface{}{"tag": "2.0"},
+	}, values)
+}
+
+func TestHelmChartInflationGeneratorValuesFromConfigMapsHashed(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	renders := filepath.Join(t.TempDir(), "renders")
+	writeFakeHelm(t, th, fmt.Sprintf(`
+echo "$1" >> %s
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+EOT
+`, renders))
+	config := fmt.Sprintf(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+addConfigHashAnnotation: true
+renderCacheDir: %s
+valuesFromConfigMaps:
+- name: chart-values
+`, t.TempDir())
+	// generate returns the config hash of the output, and
+	// the number of times helm template has run so far.
+	generate := func(tag string) (string, int) {
+		t.Helper()
+		buildResources, err := resmap.NewFactory(
+			provider.NewDefaultDepProvider().GetResourceFactory()).
+			NewResMapFromBytes([]byte(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: chart-values
+data:
+  tag: ` + tag + `
+`))
+		require.NoError(t, err)
+		g, ok := th.LoadGenerator(config).(interface {
+			resmap.Generator
+			SetBuildResources(rm resmap.ResMap)
+		})
+		require.True(t, ok)
+		g.SetBuildResources(buildResources)
+		rm, err := g.Generate()
+		require.NoError(t, err)
+		require.Len(t, rm.Resources(), 1)
+		hash := rm.Resources()[0].GetAnnotations()["kustomize.helm/config-hash"]
+		require.NotEmpty(t, hash)
+		b, err := os.ReadFile(renders)
+		require.NoError(t, err)
+		return hash, strings.Count(string(b), "template\n")
+	}
+
+	hash, renderCount := generate("v1")
+	assert.Equal(t, 1, renderCount)
+	sameHash, renderCount := generate("v1")
+	assert.Equal(t, hash, sameHash)
+	assert.Equal(t, 1, renderCount)
+	// Changing the ConfigMap's data changes the hash and misses the cache.
+	otherHash, renderCount := generate("v2")
+	assert.NotEqual(t, hash, otherHash)
+	assert.Equal(t, 2, renderCount)
+}
+
+func TestHelmChartInflationGeneratorVarReferencesHashed(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+	copyTestChartsIntoHarness(t, th)
+
+	renders := filepath.Join(t.TempDir(), "renders")
+	writeFakeHelm(t, th, fmt.Sprintf(`
+echo "$1" >> %s
+cat <<EOT
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+EOT
+`, renders))
+	config := fmt.Sprintf(`
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: test-chart
+name: test-chart
+releaseName: test
+chartHome: ./charts
+addConfigHashAnnotation: true
+renderCacheDir: %s
+varReferences:
+  image.tag: IMAGE_TAG
+`, t.TempDir())
+	vars := []types.Var{{
+		Name:     "IMAGE_TAG",
+		ObjRef:   types.Target{APIVersion: "v1", Gvk: resid.Gvk{Kind: "ConfigMap"}, Name: "release"},
+		FieldRef: types.FieldSelector{FieldPath: "data.tag"},
+	}}
+	// generate returns the config hash of the output, and
+	// the number of times helm template has run so far.
+	generate := func(tag string) (string, int) {
+		t.Helper()
+		buildResources, err := resmap.NewFactory(
+			provider.NewDefaultDepProvider().GetResourceFactory()).
+			NewResMapFromBytes([]byte(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: release
+data:
+  tag: ` + tag + `
+`))
+		require.NoError(t, err)
+		g, ok := th.LoadGenerator(config).(interface {
+			resmap.Generator
+			SetBuildResources(rm resmap.ResMap)
+			SetBuildVars(vars []types.Var)
+		})
+		require.True(t, ok)
+		g.SetBuildResources(buildResources)
+		g.SetBuildVars(vars)
+		rm, err := g.Generate()
+		require.NoError(t, err)
+		require.Len(t, rm.Resources(), 1)
+		hash := rm.Resources()[0].GetAnnotations()["kustomize.helm/config-hash"]
+		require.NotEmpty(t, hash)
+		b, err := os.ReadFile(renders)
+		require.NoError(t, err)
+		return hash, strings.Count(string(b), "template\n")
+	}
+
+	hash, renderCount := generate("v1")
+	assert.Equal(t, 1, renderCount)
+	sameHash, renderCount := generate("v1")
+	assert.Equal(t, hash, sameHash)
+	assert.Equal(t, 1, renderCount)
+	// Changing the var's value changes the hash and misses the cache.
+	otherHash, renderCount := generate("v2")
+	assert.NotEqual(t, hash, otherHash)
+	assert.Equal(t, 2, renderCount)
+}
+
+func TestHelmChartInflationGeneratorPullWrongMediaType(t *testing.T) {
+	th := kusttest_test.MakeEnhancedHarnessWithTmpRoot(t).
+		PrepBuiltin("HelmChartInflationGenerator")
+	defer th.Reset()
+
+	attempts := filepath.Join(t.TempDir(), "attempts")
+	writeFakeHelm(t, th, fmt.Sprintf(`
+echo "$1" >> %s
+echo 'Error: manifest does not contain minimum number of descriptors (2), descriptors found: 1' >&2
+exit 1
+`, attempts))
+	config := `
+apiVersion: builtin
+kind: HelmChartInflationGenerator
+metadata:
+  name: podinfo
+name: podinfo
+version: 6.2.1
+repo: %s
+releaseName: podinfo
+pullRetries: 1
+chartHome: ./charts-%d
+`
+
+	_, err := th.LoadGenerator(fmt.Sprintf(config, "oci://registry.example.com/charts", 0)).Generate()
+	require.ErrorContains(t, err,
+		"helm chart 'podinfo' in oci://registry.example.com/charts isn't stored as helm expects "+
+			"(config application/vnd.cncf.helm.config.v1+json, "+
+			"layer application/vnd.cncf.helm.chart.content.v1.tar+gzip); "+
+			"helm can't be told to expect another artifact type, so push the chart with 'helm push': ")
+	require.ErrorContains(t, err, "minimum number of descriptors (2)")
+	// Not retried.
+	b, err := os.ReadFile(attempts)
+	require.NoError(t, err)
+	assert.Equal(t, "pull\n", string(b))
+
+	// Only OCI repos have media types.
+	_, err = th.LoadGenerator(fmt.Sprintf(config, "https://charts.example.com", 1)).Generate()
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "isn't stored as helm expects")
+}